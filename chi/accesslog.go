@@ -0,0 +1,55 @@
+package chi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// An AccessLogger logs the requests handled by a Handler.
+//
+// On Go 1.21 and later, SlogAccessLogger returns an AccessLogger that logs
+// using a *slog.Logger.
+type AccessLogger interface {
+	// LogAccess is called with the context and the record of a request,
+	// when its transaction is finished.
+	LogAccess(ctx context.Context, record AccessRecord)
+}
+
+// AccessRecord is the record of a request logged by an AccessLogger.
+type AccessRecord struct {
+	// Method is the method of the request.
+	Method string
+	// Path is the path of the request's URL.
+	Path string
+	// Route is the matched route pattern, or empty, if no route was matched.
+	Route string
+	// Status is the status of the response, or 0, if no response was
+	// written, e.g. because the handler panicked.
+	Status int
+	// Duration is the duration of the request.
+	Duration time.Duration
+	// TraceID is the id of the request's trace, so that the record can be
+	// correlated with the request's transaction.
+	TraceID sentry.TraceID
+	// Panicked is true, if the handler panicked.
+	Panicked bool
+}
+
+// logAccess logs the access of a request to logger.
+func logAccess(
+	logger AccessLogger, transaction *sentry.Span, r *http.Request, routePattern string, status int,
+	duration time.Duration, panicked bool,
+) {
+	logger.LogAccess(r.Context(), AccessRecord{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Route:    routePattern,
+		Status:   status,
+		Duration: duration,
+		TraceID:  transaction.TraceID,
+		Panicked: panicked,
+	})
+}
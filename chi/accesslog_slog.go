@@ -0,0 +1,38 @@
+//go:build go1.21
+
+package chi
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// SlogAccessLogger returns an AccessLogger that logs each request as a
+// record with the message "request" to logger.
+//
+// Requests that panicked or responded with a server error are logged at
+// error level, all others at info level.
+func SlogAccessLogger(logger *slog.Logger) AccessLogger {
+	return slogAccessLogger{logger: logger}
+}
+
+type slogAccessLogger struct {
+	logger *slog.Logger
+}
+
+func (l slogAccessLogger) LogAccess(ctx context.Context, record AccessRecord) {
+	level := slog.LevelInfo
+	if record.Panicked || record.Status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	l.logger.LogAttrs(ctx, level, "request",
+		slog.String("method", record.Method),
+		slog.String("path", record.Path),
+		slog.String("route", record.Route),
+		slog.Int("status", record.Status),
+		slog.Duration("duration", record.Duration),
+		slog.String("trace_id", record.TraceID.String()),
+	)
+}
@@ -0,0 +1,49 @@
+//go:build go1.21
+
+package chi_test
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+)
+
+func TestSlogAccessLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	r, rec := newRouter(chisentry.Options{AccessLogger: chisentry.SlogAccessLogger(logger)})
+	r.Get("/users/{id}", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	r.Get("/panic", func(http.ResponseWriter, *http.Request) {
+		panic("panic")
+	})
+
+	serve(r, http.MethodGet, "/users/1")
+	serve(r, http.MethodGet, "/panic")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, but got %d:\n%s", len(lines), buf.String())
+	}
+
+	traceID, _ := rec.Transactions()[0].Event.Contexts["trace"]["trace_id"].(sentry.TraceID)
+	for _, expect := range []string{
+		"level=INFO", "msg=request", "method=GET", "path=/users/1", "route=/users/{id}", "status=418",
+		"trace_id=" + traceID.String(),
+	} {
+		if !strings.Contains(lines[0], expect) {
+			t.Errorf("expected %q to contain %q", lines[0], expect)
+		}
+	}
+	if !strings.Contains(lines[1], "level=ERROR") {
+		t.Errorf("expected the record of the panicking request to be logged at error level, but got %q", lines[1])
+	}
+}
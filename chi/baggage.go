@@ -0,0 +1,49 @@
+package chi
+
+import "strings"
+
+// normalizeBaggage merges the passed values of baggage headers into a single
+// baggage header value.
+//
+// Members with the same key are deduplicated, with the last member winning.
+// The position of a member is that of the first occurrence of its key.
+// Empty and malformed members, i.e. those without a key, are dropped.
+func normalizeBaggage(values []string) string {
+	var keys []string
+	members := make(map[string]string)
+
+	for _, v := range values {
+		for _, m := range strings.Split(v, ",") {
+			m = strings.TrimSpace(m)
+
+			kv := m
+			if i := strings.IndexByte(kv, ';'); i >= 0 {
+				kv = kv[:i]
+			}
+
+			i := strings.IndexByte(kv, '=')
+			if i <= 0 {
+				continue
+			}
+
+			key := strings.TrimSpace(kv[:i])
+			if key == "" {
+				continue
+			}
+
+			if _, ok := members[key]; !ok {
+				keys = append(keys, key)
+			}
+			members[key] = m
+		}
+	}
+
+	var b strings.Builder
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(members[key])
+	}
+	return b.String()
+}
@@ -0,0 +1,137 @@
+package chi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// BreadcrumbWriter returns an io.Writer that adds each line written to it as
+// a log breadcrumb to the hub of the request with the passed context.
+// This way, events captured during the request contain the log lines
+// written before.
+//
+// It is meant to be used as the output of a request-scoped logger, e.g.:
+//
+//	logger := log.New(chisentry.BreadcrumbWriter(r.Context()), "", 0)
+//
+// Lines are only added once they are terminated by a newline.
+//
+// If ctx has no hub, the returned writer discards everything written to it.
+func BreadcrumbWriter(ctx context.Context) io.Writer {
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		return io.Discard
+	}
+
+	return &breadcrumbWriter{hub: hub}
+}
+
+type breadcrumbWriter struct {
+	hub *sentry.Hub
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *breadcrumbWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := string(bytes.TrimSuffix(w.buf[:i], []byte{'\r'}))
+		w.buf = w.buf[i+1:]
+
+		if line != "" {
+			w.hub.AddBreadcrumb(&sentry.Breadcrumb{
+				Type:     "default",
+				Category: "log",
+				Message:  line,
+				Level:    sentry.LevelInfo,
+			}, nil)
+		}
+	}
+
+	return len(p), nil
+}
+
+// limitBreadcrumbs returns an event processor that drops all but the limit
+// most recent breadcrumbs of events.
+func limitBreadcrumbs(limit int) sentry.EventProcessor {
+	return func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+		if len(event.Breadcrumbs) > limit {
+			event.Breadcrumbs = event.Breadcrumbs[len(event.Breadcrumbs)-limit:]
+		}
+		return event
+	}
+}
+
+// DisableBreadcrumbs stops the breadcrumbs added to the hub of the request
+// with the passed context from being sent to Sentry, for the rest of the
+// request.
+// Breadcrumbs added before DisableBreadcrumbs was called are still sent.
+//
+// Note that later breadcrumbs are still recorded by the hub, and only
+// dropped when an event is sent.
+// They therefore still count towards sentry.ClientOptions.MaxBreadcrumbs,
+// and once that limit is reached, evict the breadcrumbs added before
+// DisableBreadcrumbs was called.
+//
+// This is useful to keep the events of handlers that produce a large number
+// of breadcrumbs, e.g. in a loop, within Sentry's size limits.
+//
+// If ctx is not the context of a request handled by a Handler,
+// DisableBreadcrumbs is a no-op.
+func DisableBreadcrumbs(ctx context.Context) {
+	state := requestStateFromContext(ctx)
+	if state == nil {
+		return
+	}
+
+	// The breadcrumbs are dropped by the event processor of the outermost
+	// Handler using the hub.
+	for state.outer != nil {
+		state = state.outer
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.breadcrumbsDisabled {
+		return
+	}
+	state.breadcrumbsDisabled = true
+	state.breadcrumbsDisabledAt = time.Now()
+}
+
+// dropDisabledBreadcrumbs is an event processor that drops the breadcrumbs
+// added after DisableBreadcrumbs was called for the request with state s.
+func (s *requestState) dropDisabledBreadcrumbs(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+	s.mu.Lock()
+	disabled, disabledAt := s.breadcrumbsDisabled, s.breadcrumbsDisabledAt
+	s.mu.Unlock()
+
+	if !disabled {
+		return event
+	}
+
+	breadcrumbs := event.Breadcrumbs[:0]
+	for _, b := range event.Breadcrumbs {
+		if !b.Timestamp.After(disabledAt) {
+			breadcrumbs = append(breadcrumbs, b)
+		}
+	}
+	event.Breadcrumbs = breadcrumbs
+	return event
+}
@@ -0,0 +1,33 @@
+package chi
+
+import "runtime/debug"
+
+// buildInfoTags returns the tags describing the build of the running binary,
+// or nil if the binary wasn't built with build info, or if it contains no VCS
+// information.
+func buildInfoTags() map[string]string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+
+	var tags map[string]string
+	for _, s := range info.Settings {
+		var key string
+		switch s.Key {
+		case "vcs.revision":
+			key = "vcs.revision"
+		case "vcs.time":
+			key = "build.time"
+		default:
+			continue
+		}
+
+		if tags == nil {
+			tags = make(map[string]string, 2)
+		}
+		tags[key] = s.Value
+	}
+
+	return tags
+}
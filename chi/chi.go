@@ -32,7 +32,18 @@ package chi
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -43,9 +54,93 @@ import (
 // A Handler is an HTTP middleware factory that provides integration with
 // Sentry.
 type Handler struct {
-	repanic         bool
-	waitForDelivery bool
-	timeout         time.Duration
+	repanic                    bool
+	waitForDelivery            bool
+	timeout                    time.Duration
+	panicFlushTimeout          time.Duration
+	flushOnResponse            bool
+	tailSampler                func(status int, duration time.Duration, routePattern string) bool
+	router                     chi.Routes
+	extrasFromContext          func(ctx context.Context) map[string]interface{}
+	disableRequestCapture      bool
+	panicLimiter               *rateLimiter
+	contextFunc                func(ctx context.Context, r *http.Request) context.Context
+	captureCookies             map[string]struct{}
+	slowRequestThreshold       time.Duration
+	captureSlowRequests        bool
+	attachRuntimeStatsOnPanic  bool
+	normalizeBaggage           bool
+	treatClientErrorsAsOK      bool
+	tagReferer                 bool
+	tagOrigin                  bool
+	tagHost                    bool
+	tagAcceptLanguage          bool
+	emptyPathName              string
+	tagClientCertSubject       bool
+	tagTLSInfo                 bool
+	apiVersion                 func(r *http.Request) string
+	standardAttributes         bool
+	ignorePaths                map[string]struct{}
+	ignorePrefixes             []string
+	ignorePathRegexps          []*regexp.Regexp
+	skipMethods                []string
+	nestedTransactionPolicy    NestedTransactionPolicy
+	environmentFromHost        func(host string) string
+	nameNormalizer             func(name string) string
+	echoTraceHeader            bool
+	onPanic                    func(w http.ResponseWriter, r *http.Request, v interface{})
+	buildInfoTags              map[string]string
+	maxEventDataBytes          int
+	hierarchicalRouteTags      bool
+	countChildSpansByOp        bool
+	requestTiming              RequestTiming
+	maxResponseBodyCapture     int
+	spanOptions                []sentry.SpanOption
+	spanOptionsFunc            func(r *http.Request) []sentry.SpanOption
+	claimsTagger               func(r *http.Request) map[string]string
+	deferredFinishTimeout      time.Duration
+	transactionNameHeader      string
+	stripTransactionNameHeader bool
+	alwaysSampleErrors         bool
+	skipCanceledRequests       bool
+	setTransactionDescription  bool
+	lowMemoryPanicReport       bool
+	recordSampleRate           bool
+	metricsObserver            MetricsObserver
+
+	// inFlight tracks the transactions that haven't been finished yet.
+	inFlight                inFlightTracker
+	notFoundStatus          bool
+	hubProvider             func(r *http.Request) *sentry.Hub
+	cacheStatusHeader       string
+	emitTraceResponse       bool
+	routingSpan             bool
+	recordDeadline          bool
+	sanitizeURLNames        bool
+	externalTraceIDHeader   string
+	externalTraceTagName    string
+	latencyBuckets          []time.Duration
+	captureOnlyWhenSampled  bool
+	accessLogger            AccessLogger
+	minimalRequestCapture   bool
+	routeName               func(routePattern, method string) string
+	maxBreadcrumbs          int
+	cohortFromRequest       func(r *http.Request) string
+	initialTransactionName  string
+	cronMonitor             func(r *http.Request) (slug string, ok bool)
+	maxRequestBodySize      int64
+	traceContextData        func(r *http.Request) map[string]interface{}
+	queueStartHeader        string
+	tagCacheValidators      bool
+	captureDeadlineExceeded bool
+	// providedClients holds the clients of the hubs returned by
+	// Options.HubProvider, so that they can be flushed on Shutdown.
+	providedClients sync.Map
+
+	// now returns the current time.
+	// All durations are measured using now, so that it can be replaced in
+	// tests.
+	now func() time.Time
 }
 
 // Options configure a Handler.
@@ -55,6 +150,16 @@ type Options struct {
 	// behavior from Go's http package, as documented in
 	// https://golang.org/pkg/net/http/#Handler.
 	Repanic bool
+	// PanicPropagateInTest configures whether to repanic after recovering
+	// from a panic, if the program is a test binary built by go test.
+	// Panics are still reported to Sentry.
+	//
+	// This lets the testing package fail tests with the stack trace of the
+	// original panic, which would otherwise be hidden by the Handler, while
+	// keeping the production behavior of the Handler unchanged.
+	// It is therefore recommended to enable PanicPropagateInTest alongside
+	// your production options, instead of setting Repanic in tests.
+	PanicPropagateInTest bool
 	// WaitForDelivery indicates, in case of a panic, whether to block the
 	// current goroutine and wait until the panic event has been reported to
 	// Sentry before repanicking or resuming normal execution.
@@ -67,31 +172,982 @@ type Options struct {
 	// in an environment that interrupts execution at the end of a request flow,
 	// like modern serverless platforms.
 	WaitForDelivery bool
-	// Timeout for the delivery of panic events. Defaults to 2s. Only relevant
-	// when WaitForDelivery is true.
+	// Timeout for the delivery of events. Defaults to 2s. Only relevant
+	// when WaitForDelivery or FlushOnResponse is true.
 	//
 	// If the timeout is reached, the current goroutine is no longer blocked
 	// waiting, but the delivery is not canceled.
 	Timeout time.Duration
+	// PanicFlushTimeout is the timeout for the delivery of panic events, if
+	// WaitForDelivery is true.
+	// Defaults to Timeout.
+	//
+	// This allows waiting longer for panic events, which are usually more
+	// important than the happy path, than for the events flushed because of
+	// FlushOnResponse.
+	PanicFlushTimeout time.Duration
+	// FlushOnResponse configures whether to block the current goroutine
+	// after the request was handled, and wait until all events, including the
+	// transaction of the request, have been sent to Sentry.
+	//
+	// Like WaitForDelivery, this is useful in environments that interrupt
+	// execution at the end of a request.
+	FlushOnResponse bool
+	// TailSampler, if set, is called after the request was handled and
+	// decides whether the transaction should be sent to Sentry.
+	// It receives the response status, the duration of the request, and the
+	// matched route pattern.
+	// If it returns false, the transaction is dropped.
+	//
+	// The TailSampler can only drop transactions, not keep them: it is only
+	// consulted for transactions that were sampled by the SDK's
+	// TracesSampleRate or TracesSampler when the transaction was started.
+	// To make a tail-based decision about all requests, configure the head
+	// sampler to keep every transaction.
+	TailSampler func(status int, duration time.Duration, routePattern string) bool
+	// Router is the router the Handler is used with, typically a *chi.Mux.
+	//
+	// If set, the route pattern of a request is resolved before the request
+	// is handled, and the transaction is named after it from the start.
+	// This way, events captured early in the handler are already attributed
+	// to the route, instead of to the request's raw path.
+	//
+	// If not set, the transaction is only renamed after the request was
+	// handled.
+	Router chi.Routes
+	// ExtrasFromContext, if set, is called with the request's context before
+	// the request is handled.
+	// The returned extras are added to the scope of the request's hub.
+	//
+	// This allows passing along data that previous middlewares stored in the
+	// request's context, without them needing to be aware of Sentry.
+	// ExtrasFromContext may return nil.
+	ExtrasFromContext func(ctx context.Context) map[string]interface{}
+	// DisableRequestCapture disables adding the request to the scope of the
+	// request's hub.
+	//
+	// This saves the overhead of attaching the request to every event, and
+	// prevents personal data contained in the request from being sent to
+	// Sentry.
+	// However, events will no longer contain information about the request,
+	// unless it is added manually.
+	DisableRequestCapture bool
+	// MaxPanicReportsPerSecond limits the number of panics reported to
+	// Sentry per second, across all requests handled by the Handler.
+	// Panics exceeding the limit are still recovered from, and repanicked if
+	// Repanic is set, but not reported.
+	//
+	// This prevents a flood of identical panics, e.g. caused by the outage of
+	// a dependency, from stalling the server when WaitForDelivery is set.
+	//
+	// If MaxPanicReportsPerSecond is 0, panic reports are not limited.
+	MaxPanicReportsPerSecond int
+	// ContextFunc, if set, is called before the request is handled, and
+	// returns the context that is used for the request instead of ctx.
+	//
+	// ctx already holds the request's hub and transaction.
+	// Therefore, the returned context must be derived from ctx, and not
+	// replace it.
+	ContextFunc func(ctx context.Context, r *http.Request) context.Context
+	// CaptureCookies is a list of the names of the cookies to capture.
+	//
+	// If set, only the listed cookies are attached to events, regardless of
+	// whether cookies are captured as part of the request because
+	// SendDefaultPII is enabled.
+	// If DisableRequestCapture is set, the cookies are attached as an extra
+	// instead.
+	CaptureCookies []string
+	// SlowRequestThreshold is the duration after which a request is
+	// considered slow.
+	// It is only used if CaptureSlowRequests is set.
+	SlowRequestThreshold time.Duration
+	// CaptureSlowRequests configures whether to capture a warning message for
+	// every request that took longer than SlowRequestThreshold.
+	//
+	// The message contains the route, duration and response status of the
+	// request.
+	// Requests skipped using Skip are never reported.
+	CaptureSlowRequests bool
+	// AttachRuntimeStatsOnPanic configures whether to attach statistics about
+	// the Go runtime, such as memory usage and the number of goroutines, to
+	// the events of recovered panics.
+	//
+	// This helps identifying panics caused by memory pressure.
+	// Note that collecting the statistics stops the world for a short time.
+	AttachRuntimeStatsOnPanic bool
+	// NormalizeBaggage configures whether to normalize the baggage headers of
+	// incoming requests before continuing their trace.
+	//
+	// If set, the values of all baggage headers are merged, and members with
+	// duplicate keys are removed, keeping the last one.
+	// This is useful if requests pass through multiple proxies that each add
+	// baggage, which may otherwise result in dynamic sampling contexts that
+	// are oversized or contain conflicting values.
+	NormalizeBaggage bool
+	// TreatClientErrorsAsOK configures whether responses with a 4xx status
+	// should be considered successful.
+	//
+	// By default, the status of a transaction reflects the HTTP status of the
+	// response, which means that client errors count as failed transactions.
+	// If TreatClientErrorsAsOK is set, transactions of responses with a 2xx
+	// to 4xx status have the status ok, so that only server errors count as
+	// failures.
+	TreatClientErrorsAsOK bool
+	// TagReferer configures whether to tag events with the Referer header of
+	// the request, if present.
+	// The tag is named http.referer, and its value is truncated to 200 bytes.
+	TagReferer bool
+	// TagOrigin configures whether to tag events with the Origin header of
+	// the request, if present.
+	// The tag is named http.origin, and its value is truncated to 200 bytes.
+	TagOrigin bool
+	// TagHost configures whether to tag events with the host the request was
+	// sent to, as found in the request's Host header.
+	// This allows filtering events by the domain a request was made to, if
+	// the server serves multiple domains.
+	// The tag is named http.host, and its value is truncated to 200 bytes.
+	//
+	// The physical host the server runs on is reported by Sentry as the
+	// server_name of events.
+	TagHost bool
+	// TagAcceptLanguage configures whether to tag events with the language
+	// the client prefers, i.e. the first language of the Accept-Language
+	// header of the request.
+	// The tag is named locale.
+	//
+	// If the header is missing or malformed, or its first language is the
+	// wildcard "*", no tag is set.
+	TagAcceptLanguage bool
+	// EmptyPathName is the name used for the transaction of a request that
+	// has an empty path, as is the case for CONNECT requests.
+	// It is only used until the transaction is renamed after the matched
+	// route.
+	//
+	// Defaults to the method of the request followed by " <unknown>".
+	EmptyPathName string
+	// TagClientCertSubject configures whether to tag events with the common
+	// name of the subject of the client certificate, if the request was made
+	// using mutual TLS.
+	// The tag is named tls.client_subject.
+	TagClientCertSubject bool
+	// TagTLSInfo configures whether to tag events of requests made over TLS
+	// with the TLS version and cipher suite used, e.g. "TLS 1.3" and
+	// "TLS_AES_128_GCM_SHA256".
+	// The tags are named tls.version and tls.cipher_suite.
+	TagTLSInfo bool
+	// APIVersion, if set, is called before the request is handled and returns
+	// the version of the API that is requested.
+	// The version is set as the api.version tag.
+	// If APIVersion returns "", no tag is set.
+	//
+	// Use VersionFromAccept to extract the version from vendor media types in
+	// the Accept header.
+	APIVersion func(r *http.Request) string
+	// StandardAttributes configures whether to record the attributes defined
+	// by the OpenTelemetry semantic conventions for HTTP servers as data on
+	// transactions.
+	//
+	// Currently, these are:
+	//
+	//   - net.peer.ip: the IP address of the client
+	//   - net.peer.port: the port of the client
+	StandardAttributes bool
+	// IgnorePaths is a list of paths of requests that are not traced.
+	// Panics are still recovered from and reported, however.
+	//
+	// DefaultIgnorePaths contains paths commonly used by infrastructure.
+	IgnorePaths []string
+	// IgnorePrefixes is a list of path prefixes of requests that are not
+	// traced.
+	// Panics are still recovered from and reported, however.
+	//
+	// DefaultIgnorePrefixes contains prefixes commonly used by
+	// infrastructure.
+	IgnorePrefixes []string
+	// IgnorePathRegexps is a list of regular expressions matched against the
+	// path of each request.
+	// Requests whose path matches any of them are not traced.
+	// Panics are still recovered from and reported, however.
+	IgnorePathRegexps []*regexp.Regexp
+	// SkipMethods is a list of HTTP methods, e.g. http.MethodOptions and
+	// http.MethodHead, of requests that are not traced.
+	// This is useful to reduce the number of transactions caused by CORS
+	// preflight requests.
+	// Panics are still recovered from and reported, however.
+	SkipMethods []string
+	// NestedTransactionPolicy configures how requests are handled whose
+	// context already holds a transaction, e.g. because they were already
+	// traced by another middleware.
+	//
+	// If the existing transaction was started by another Handler, both
+	// Handlers share the scope of the request's hub.
+	// Options that are implemented by event processors, such as
+	// CaptureCookies, then only take effect on the outer Handler, so that the
+	// processors don't run twice for every event.
+	//
+	// Defaults to NestedTransactionAdopt.
+	NestedTransactionPolicy NestedTransactionPolicy
+	// EnvironmentFromHost, if set, is called with the host of each request,
+	// and returns the environment the events of the request should be
+	// attributed to.
+	//
+	// This is useful if a single deployment serves multiple environments,
+	// e.g. preview deployments addressed through different subdomains.
+	//
+	// If EnvironmentFromHost returns "", the environment configured in the
+	// client is used.
+	EnvironmentFromHost func(host string) string
+	// NameNormalizer, if set, is called with the final name of each
+	// transaction, after it was named after the matched route or the
+	// request's path, and returns the name to use instead.
+	//
+	// It can be used to replace IDs and other high-cardinality parts of
+	// names, e.g. for requests handled by catch-all routes.
+	NameNormalizer func(name string) string
+	// EchoTraceHeader configures whether to add a sentry-trace header to the
+	// response, that contains the trace id, span id and sampling decision of
+	// the request's transaction.
+	// This allows clients to find out whether and how a request was traced.
+	//
+	// The header is set before the request is handled.
+	// It is therefore only sent if no previous middleware has already written
+	// the response's header.
+	EchoTraceHeader bool
+	// OnPanic, if set, is called after recovering from a panic, with the
+	// value the handler panicked with.
+	// It can be used to clean up, or to respond with an error.
+	//
+	// Panics are handled in the following order:
+	//
+	//  1. The panic is reported to Sentry.
+	//  2. If WaitForDelivery is set, the delivery of the event is waited for.
+	//  3. OnPanic is called.
+	//  4. If Repanic is set, the handler panics again.
+	//     Otherwise, it returns normally.
+	OnPanic func(w http.ResponseWriter, r *http.Request, v interface{})
+	// AttachBuildInfo configures whether to tag events with the VCS revision
+	// and time of the build of the running binary, as embedded by the go
+	// command.
+	// The tags are named vcs.revision and build.time.
+	//
+	// The build info is read once, when the Handler is created.
+	// If the binary contains no VCS information, e.g. because it was built
+	// using go run, no tags are set.
+	AttachBuildInfo bool
+	// MaxEventDataBytes is the maximum size of the events of a request, in
+	// bytes.
+	//
+	// Events exceeding the size may be dropped by Sentry.
+	// To prevent this, data is dropped from events exceeding the size, until
+	// they fit, starting with the request's body and cookies, followed by
+	// the extras of the event.
+	// Events that data was dropped from are tagged with event.truncated.
+	//
+	// Note that determining the size of an event requires encoding it.
+	//
+	// If MaxEventDataBytes is 0, events are not limited.
+	MaxEventDataBytes int
+	// HierarchicalRouteTags configures whether to tag transactions with the
+	// route patterns of the routers a request was routed through.
+	//
+	// For example, a request to /api/v2/users/{id}, handled by a router
+	// mounted at /v2 in a router mounted at /api, is tagged with
+	// route.l1=/api, route.l2=/v2, route.l3=/users/{id} and
+	// route.full=/api/v2/users/{id}.
+	HierarchicalRouteTags bool
+	// CountChildSpansByOp configures whether to count the child spans of
+	// transactions by the category of their op, i.e. the part of the op
+	// before the first dot.
+	// The counts are recorded as spans.<category>_count data, e.g.
+	// spans.db_count or spans.http_count.
+	//
+	// This helps to spot N+1 query patterns without having to look at the
+	// spans of a transaction.
+	CountChildSpansByOp bool
+	// RequestTiming configures when the request is added to the scope of the
+	// request's hub.
+	//
+	// Defaults to RequestTimingEarly.
+	RequestTiming RequestTiming
+	// MaxResponseBodyCapture is the maximum number of bytes of the body of a
+	// response with a 5xx status to capture.
+	// The captured body is attached to the events of the request as the
+	// response.body extra.
+	//
+	// Only the bodies of responses with a 5xx status are buffered, and only
+	// up to MaxResponseBodyCapture bytes.
+	// Note however, that capturing the body prevents the use of optimized
+	// implementations of io.ReaderFrom, such as sendfile, for all responses.
+	//
+	// If MaxResponseBodyCapture is 0, response bodies are not captured.
+	MaxResponseBodyCapture int
+	// SpanOptions are additional options used to start the transactions of
+	// requests.
+	//
+	// They are applied after the built-in options, which set the op,
+	// continue the trace of the request, and set the source of the
+	// transaction's name, and can therefore override them.
+	// The name of the transaction cannot be overridden.
+	SpanOptions []sentry.SpanOption
+	// SpanOptionsFunc, if set, is called for each request, and returns
+	// additional options used to start the request's transaction.
+	//
+	// The returned options are applied after the built-in options and
+	// SpanOptions.
+	SpanOptionsFunc func(r *http.Request) []sentry.SpanOption
+	// ClaimsTagger, if set, is called before the request is handled, and
+	// returns tags derived from the claims of the request's credentials,
+	// e.g. the tenant or plan found in a JWT.
+	// The tags are set on the scope of the request's hub.
+	//
+	// ClaimsTagger may return nil, e.g. if the request is unauthenticated.
+	ClaimsTagger func(r *http.Request) map[string]string
+	// DeferredFinishTimeout is the time after which the transaction of a
+	// request, whose finishing was deferred using DeferFinish, is finished,
+	// if it wasn't finished by then.
+	// The timeout starts when the handler returns.
+	//
+	// Defaults to 5m.
+	DeferredFinishTimeout time.Duration
+	// TransactionNameHeader is the name of a response header, that handlers
+	// can set to name the transaction of the request, without importing this
+	// package.
+	// If the header is set when the transaction is finished, its value is
+	// used as the transaction's name, overriding the name derived from the
+	// route pattern.
+	//
+	// If TransactionNameHeader is empty, the names of transactions are not
+	// taken from the response.
+	TransactionNameHeader string
+	// StripTransactionNameHeader configures whether to remove the
+	// TransactionNameHeader from the response, before it is sent to the
+	// client.
+	//
+	// To do so, the response writer is wrapped before it is passed to the
+	// handler.
+	// Optional interfaces, such as http.Hijacker or http.Flusher, are then
+	// always implemented by the response writer, but fail or do nothing if
+	// the underlying writer doesn't implement them.
+	StripTransactionNameHeader bool
+	// AlwaysSampleErrors configures whether to always send the transactions
+	// of requests that panicked or responded with a server error, even if
+	// they weren't sampled by the head sampling decision, or TailSampler.
+	// Transactions dropped using Skip are still dropped.
+	//
+	// Since the sampling decision is made before the request is handled, and
+	// propagated to downstream services, their spans are missing from the
+	// trace of such a transaction, if it wasn't sampled initially.
+	// The spans of this service are included, however.
+	// Combine AlwaysSampleErrors with a high sample rate, if complete traces
+	// are needed.
+	AlwaysSampleErrors bool
+	// SkipCanceledRequests configures whether to skip requests whose context
+	// is already done when they reach the Handler, e.g. because the client
+	// disconnected while previous middleware was running.
+	//
+	// Such requests are neither traced, nor passed to the wrapped handler,
+	// and no response is written.
+	// Requests whose context is done while they are being handled are traced
+	// and handled as usual.
+	SkipCanceledRequests bool
+	// SetTransactionDescription configures whether to set the description
+	// of transactions, which is shown in the trace view, to the matched
+	// route pattern of the request.
+	// If no route was matched, the path of the request is used instead.
+	// Query parameters are never included.
+	//
+	// The name of the transaction, which is used for grouping, is not
+	// affected.
+	SetTransactionDescription bool
+	// LowMemoryPanicReport configures whether to report panics using a
+	// minimal event, that only contains the type and message of the panic
+	// value, and the route pattern of the request in the route tag.
+	// Neither a stack trace, nor the request, nor any other data of the
+	// request's scope is included.
+	//
+	// This reduces the allocations needed to report a panic, increasing the
+	// chance of it being delivered when the panic was caused by memory
+	// pressure.
+	LowMemoryPanicReport bool
+	// RecordSampleRate configures whether to store the sample rate used to
+	// decide whether to sample a transaction in its sentry.sample_rate data.
+	//
+	// The sample rate is taken from the dynamic sampling context of the
+	// transaction, i.e. from the baggage header of the request, if the trace
+	// was continued from an upstream service, or from the rate the SDK used
+	// to sample the transaction otherwise.
+	// If the sample rate is unknown, e.g. because the upstream service
+	// didn't propagate it, no data is stored.
+	//
+	// Sampling decisions made by TailSampler or AlwaysSampleErrors are not
+	// reflected by the sample rate.
+	RecordSampleRate bool
+	// MetricsObserver, if set, is notified of each traced request when its
+	// transaction is finished, so that metrics, e.g. Prometheus histograms,
+	// can be recorded without wrapping the response writer a second time.
+	//
+	// It is notified regardless of whether the transaction is sampled.
+	MetricsObserver MetricsObserver
+	// NotFoundStatus configures whether to record requests that didn't match
+	// a route, and for which no response was written explicitly, with the
+	// status 404 Not Found.
+	// By default, the status of such requests is unknown, although the
+	// client receives an empty 200 OK response.
+	//
+	// Requests that panicked are not affected.
+	NotFoundStatus bool
+	// HubProvider, if set, returns the hub used for a request, e.g. a hub
+	// bound to the client of the tenant the request was made by.
+	// The hub is stored in the request's context, replacing any hub already
+	// stored there.
+	//
+	// The returned hub must not be used by concurrent requests, as its scope
+	// is modified by the Handler.
+	// If HubProvider returns nil, or isn't set, the hub stored in the
+	// request's context is used, or, if there is none, a clone of
+	// sentry.CurrentHub.
+	HubProvider func(r *http.Request) *sentry.Hub
+	// CacheStatusHeader is the name of a response header, e.g. X-Cache, that
+	// handlers set to indicate whether the response was served from a
+	// cache.
+	// If set, the value of the header is used as the cache.status tag of the
+	// request's transaction, so that the performance of cache hits and
+	// misses can be compared.
+	//
+	// If the response doesn't have the header, no tag is set.
+	CacheStatusHeader string
+	// Strict configures whether New validates the Options using Validate,
+	// and panics if they are invalid.
+	// This surfaces misconfigurations at startup.
+	Strict bool
+	// EmitTraceResponse configures whether to add a W3C traceresponse header
+	// to the response, which allows clients, e.g. those instrumented with
+	// OpenTelemetry, to confirm that their trace was continued.
+	//
+	// The header has the format
+	//
+	//	00-<trace id>-<span id>-<flags>
+	//
+	// where the span id is the id of the request's transaction, and flags
+	// is 01, if the transaction is sampled, and 00 otherwise.
+	//
+	// Like the header of EchoTraceHeader, the header is set before the
+	// request is handled, and is therefore only sent if no previous
+	// middleware has already written the response's header.
+	EmitTraceResponse bool
+	// RoutingSpan configures whether to start a child span with the op
+	// http.route when the Handler passes the request on, which covers the
+	// time spent in the middleware and router before the request reaches
+	// its endpoint handler.
+	//
+	// The span is finished by the EndRouting middleware, which must be the
+	// last middleware applied to the routes, or, if the request never
+	// reaches it, when the transaction is finished.
+	// For the span to cover all middleware, the Handler should be the
+	// outermost one.
+	RoutingSpan bool
+	// RecordDeadline configures whether to store the time remaining until
+	// the deadline of the request's context, as it reaches the Handler, in
+	// the http.request.deadline_ms data of the request's transaction.
+	// This helps to interpret transactions with the deadline_exceeded status.
+	//
+	// If the request's context has no deadline, no data is stored.
+	RecordDeadline bool
+	// SanitizeURLNames configures whether to apply SanitizeIDs to the names
+	// of transactions of requests that didn't match a route, and are
+	// therefore named after their path.
+	//
+	// It is applied before NameNormalizer.
+	SanitizeURLNames bool
+	// ExternalTraceIDHeader is the name of a request header containing the
+	// id of the trace of another tracing system, e.g. x-datadog-trace-id.
+	// If set, and the request has the header, its value is used as a tag of
+	// the request's transaction, which allows navigating between both
+	// systems.
+	ExternalTraceIDHeader string
+	// ExternalTraceTagName is the name of the tag set by
+	// ExternalTraceIDHeader.
+	//
+	// Defaults to external.trace_id.
+	ExternalTraceTagName string
+	// LatencyBuckets are the upper bounds of the buckets, in ascending order,
+	// that the durations of requests are classified into.
+	// If set, the bucket of a request is used as the latency_bucket tag of
+	// its transaction, allowing to alert on shifts in latency.
+	//
+	// For example, the buckets 100ms and 500ms produce the tags "<100ms",
+	// "100ms-500ms" and ">=500ms".
+	//
+	// Unsorted buckets are reported by Validate, and sorted by New.
+	LatencyBuckets []time.Duration
+	// CaptureOnlyWhenSampled configures whether to skip capturing the
+	// request, including its body, as well as cookies and response bodies,
+	// if the request's transaction is not sampled, and therefore won't be
+	// sent.
+	// This reduces the overhead of requests when using low sample rates.
+	//
+	// Note that the events of errors and panics captured during requests
+	// whose transactions are not sampled then lack that data, too.
+	CaptureOnlyWhenSampled bool
+	// AccessLogger, if set, is used to log one record per traced request,
+	// when its transaction is finished.
+	// The record contains the method, path, route pattern, status and
+	// duration of the request, as well as the id of its trace, so that it
+	// can be correlated with the request's transaction.
+	// Requests that are not traced, e.g. because of IgnorePaths, are not
+	// logged.
+	//
+	// On Go 1.21 and later, use SlogAccessLogger to log using a
+	// *slog.Logger.
+	AccessLogger AccessLogger
+	// MinimalRequestCapture configures whether to add a compact description
+	// of the request to events, instead of the full request.
+	// The description is stored in the http context of events, and contains
+	// the method, host, path and matched route pattern of the request, as
+	// well as the status of the response, if one was written yet.
+	//
+	// Unlike the full request, it contains no headers, cookies, query
+	// parameters or body, and therefore neither personal data, nor large
+	// amounts of data, but also less information to debug with.
+	// RequestTiming has no effect on the description, which is always
+	// added.
+	//
+	// If DisableRequestCapture is set, MinimalRequestCapture has no effect.
+	MinimalRequestCapture bool
+	// RouteName, if set, is called with the matched route pattern and the
+	// method of a request when its transaction is finished, and returns a
+	// human-friendly name of the route, e.g. "CreateOrder".
+	// The name is used as the route.name tag of the transaction.
+	//
+	// RouteName is not called for requests that didn't match a route.
+	// If it returns an empty string, no tag is set.
+	RouteName func(routePattern, method string) string
+	// MaxBreadcrumbs is the maximum number of breadcrumbs sent with the
+	// events of a request, keeping the most recent ones.
+	// It can only lower the limit set by sentry.ClientOptions.MaxBreadcrumbs,
+	// which also limits the number of breadcrumbs kept by the scope of the
+	// request's hub.
+	//
+	// If MaxBreadcrumbs is 0, only the limit of the client is applied.
+	MaxBreadcrumbs int
+	// CohortFromRequest, if set, is called before the request is handled,
+	// and returns the deployment cohort the request was routed to, e.g.
+	// "canary" or "baseline", as indicated by a header or cookie set by a
+	// load balancer.
+	// The cohort is used as the cohort tag of the events of the request,
+	// allowing to compare the error rates and performance of canary
+	// deployments with those of the baseline.
+	//
+	// If CohortFromRequest returns an empty string, no tag is set.
+	CohortFromRequest func(r *http.Request) string
+	// InitialTransactionName, if set, is used as the name of transactions
+	// until the route pattern of the request is known, e.g. "<unrouted>",
+	// instead of the path of the request.
+	// Requests that never match a route keep that name.
+	//
+	// This guarantees that no paths, which may contain ids, are used as the
+	// names of transactions, not even for requests that fail before they
+	// are routed.
+	// It takes precedence over EmptyPathName.
+	InitialTransactionName string
+	// CronMonitor, if set, is called before the request is handled, and
+	// returns the slug of the Sentry cron monitor the request is a check-in
+	// of, e.g. for endpoints that are called by a scheduler.
+	//
+	// For such requests, an in-progress check-in is sent before the request
+	// is handled, and a check-in with the ok status, or, if the request
+	// panicked or responded with a server error, the error status, is sent
+	// when its transaction is finished.
+	//
+	// Requests for which CronMonitor returns false are unaffected.
+	CronMonitor func(r *http.Request) (slug string, ok bool)
+	// MaxRequestBodySize is the maximum size of the bodies of requests, in
+	// bytes.
+	//
+	// Requests whose Content-Length exceeds the limit are rejected with 413
+	// Request Entity Too Large, without calling the wrapped handler.
+	// Their transactions are tagged with rejected.reason=body_too_large.
+	// The bodies of requests of unknown length are limited using
+	// http.MaxBytesReader, so that reading beyond the limit fails with an
+	// *http.MaxBytesError, which the handler must respond to.
+	//
+	// MaxRequestBodySize only limits the requests' bodies, and is
+	// independent of sentry.ClientOptions.MaxRequestBodySize, which
+	// configures how much of a body is captured.
+	// If MaxRequestBodySize is 0, the bodies of requests are not limited.
+	MaxRequestBodySize int64
+	// TraceContextData, if set, is called before the request is handled,
+	// and returns data added to the trace context of the request's
+	// transaction, which is shown in the trace view.
+	// Unlike tags, the data is not indexed, and may therefore contain
+	// arbitrary values.
+	//
+	// The data is stored in the data field of the trace context, so that it
+	// can't collide with the fields managed by the SDK.
+	// If TraceContextData returns nil, no data is added.
+	TraceContextData func(r *http.Request) map[string]interface{}
+	// QueueStartHeader is the name of a request header, e.g. X-Queue-Start,
+	// that a load balancer or proxy sets to the time it received the
+	// request.
+	// If set, and the request has the header, a child span with the op
+	// queue.wait is added to the request's transaction, that covers the time
+	// the request was queued before reaching the Handler.
+	//
+	// The header's value may be prefixed with "t=", and must be a Unix
+	// timestamp in seconds, with or without a fractional part, or in
+	// milliseconds or microseconds.
+	// If it can't be parsed, or lies in the future, no span is added.
+	QueueStartHeader string
+	// TagCacheValidators configures whether to store the cache validators of
+	// responses, i.e. the values of their ETag and Last-Modified headers, in
+	// the http.response.etag and http.response.last_modified data of the
+	// request's transaction, if present.
+	// Additionally, if the response has the status 304 Not Modified, the
+	// http.response.not_modified data is set to true.
+	//
+	// This helps debugging conditional requests and caching.
+	TagCacheValidators bool
+	// CaptureDeadlineExceeded configures whether to capture a warning, when
+	// the deadline of the context of a request was exceeded by the time its
+	// transaction is finished.
+	// The warning contains the route pattern and the duration of the
+	// request.
+	//
+	// To prevent duplicates, no warning is captured if an event was already
+	// captured using the request's hub, e.g. because the handler reported
+	// the exceeded deadline itself.
+	// Requests skipped using Skip are ignored.
+	//
+	// Only deadlines of the context of the request as it reached the Handler
+	// are considered.
+	// Deadlines set by middleware wrapped by the Handler, e.g. by
+	// middleware.Timeout, are not visible to it.
+	CaptureDeadlineExceeded bool
+}
+
+// RequestTiming is the point in time at which the request is added to the
+// scope of the request's hub.
+type RequestTiming uint8
+
+const (
+	// RequestTimingEarly adds the request before it is handled, so that all
+	// events captured during the request contain it.
+	RequestTimingEarly RequestTiming = iota
+	// RequestTimingLate adds the request only to the transaction of the
+	// request, which is sent after the request was handled.
+	//
+	// Events captured while the request is handled, including those of
+	// panics, won't contain the request.
+	// Further, the request's body isn't captured.
+	RequestTimingLate
+)
+
+var (
+	// DefaultIgnorePaths are paths commonly used by infrastructure, such as
+	// health checks, metrics endpoints, and browsers.
+	// They can be added to Options.IgnorePaths:
+	//
+	//	chisentry.New(chisentry.Options{IgnorePaths: chisentry.DefaultIgnorePaths})
+	DefaultIgnorePaths = []string{
+		"/healthz",
+		"/readyz",
+		"/livez",
+		"/health",
+		"/ping",
+		"/metrics",
+		"/favicon.ico",
+		"/robots.txt",
+	}
+	// DefaultIgnorePrefixes are path prefixes commonly used by
+	// infrastructure.
+	// They can be added to Options.IgnorePrefixes.
+	DefaultIgnorePrefixes = []string{
+		"/.well-known/",
+		"/debug/pprof/",
+	}
+)
+
+// A MetricsObserver observes the requests handled by a Handler.
+type MetricsObserver interface {
+	// Observe is called with the matched route pattern, the method, the
+	// response status and the duration of a request.
+	//
+	// The route pattern is empty, if no route was matched, and the status is
+	// 0, if no response was written, e.g. because the handler panicked.
+	Observe(route, method string, status int, duration time.Duration)
 }
 
+// NestedTransactionPolicy is the policy for requests whose context already
+// holds a transaction.
+type NestedTransactionPolicy uint8
+
+const (
+	// NestedTransactionAdopt adopts the existing transaction, as if it were
+	// started by the Handler.
+	// The transaction is renamed after the matched route and its status is
+	// set according to the response.
+	// If the transaction was started by another Handler, that Handler leaves
+	// finishing it to the adopting one.
+	NestedTransactionAdopt NestedTransactionPolicy = iota
+	// NestedTransactionChild leaves the existing transaction untouched, and
+	// traces the request in a child span of it instead.
+	// The span is described by the matched route.
+	//
+	// Since only transactions can be sampled, TailSampler and Skip have no
+	// effect on such requests.
+	NestedTransactionChild
+	// NestedTransactionSkip leaves the existing transaction untouched, and
+	// doesn't trace the request.
+	// Panics are still recovered from and reported, however.
+	NestedTransactionSkip
+)
+
 // New returns a new Handler. Use the Handle and HandleFunc methods to wrap
 // existing HTTP handlers.
+//
+// If options.Strict is set, New panics if the options are invalid, as
+// reported by Options.Validate.
 func New(options Options) *Handler {
+	if options.Strict {
+		if err := options.Validate(); err != nil {
+			panic(err)
+		}
+	}
+
 	timeout := options.Timeout
 	if timeout == 0 {
 		timeout = 2 * time.Second
 	}
+	panicFlushTimeout := options.PanicFlushTimeout
+	if panicFlushTimeout == 0 {
+		panicFlushTimeout = timeout
+	}
+	deferredFinishTimeout := options.DeferredFinishTimeout
+	if deferredFinishTimeout == 0 {
+		deferredFinishTimeout = 5 * time.Minute
+	}
+
+	var panicLimiter *rateLimiter
+	if options.MaxPanicReportsPerSecond > 0 {
+		panicLimiter = newRateLimiter(options.MaxPanicReportsPerSecond)
+	}
+
+	var buildInfo map[string]string
+	if options.AttachBuildInfo {
+		buildInfo = buildInfoTags()
+	}
+
+	externalTraceTagName := options.ExternalTraceTagName
+	if externalTraceTagName == "" {
+		externalTraceTagName = "external.trace_id"
+	}
+
+	var latencyBuckets []time.Duration
+	if len(options.LatencyBuckets) > 0 {
+		latencyBuckets = append(latencyBuckets, options.LatencyBuckets...)
+		sort.Slice(latencyBuckets, func(i, j int) bool { return latencyBuckets[i] < latencyBuckets[j] })
+	}
+
+	var ignorePaths map[string]struct{}
+	if len(options.IgnorePaths) > 0 {
+		ignorePaths = make(map[string]struct{}, len(options.IgnorePaths))
+		for _, p := range options.IgnorePaths {
+			ignorePaths[p] = struct{}{}
+		}
+	}
+
+	var captureCookies map[string]struct{}
+	if len(options.CaptureCookies) > 0 {
+		captureCookies = make(map[string]struct{}, len(options.CaptureCookies))
+		for _, name := range options.CaptureCookies {
+			captureCookies[name] = struct{}{}
+		}
+	}
+
 	return &Handler{
-		repanic:         options.Repanic,
-		timeout:         timeout,
-		waitForDelivery: options.WaitForDelivery,
+		repanic:                    options.Repanic || options.PanicPropagateInTest && isTestBinary(),
+		timeout:                    timeout,
+		panicFlushTimeout:          panicFlushTimeout,
+		flushOnResponse:            options.FlushOnResponse,
+		waitForDelivery:            options.WaitForDelivery,
+		tailSampler:                options.TailSampler,
+		router:                     options.Router,
+		extrasFromContext:          options.ExtrasFromContext,
+		disableRequestCapture:      options.DisableRequestCapture,
+		panicLimiter:               panicLimiter,
+		contextFunc:                options.ContextFunc,
+		captureCookies:             captureCookies,
+		slowRequestThreshold:       options.SlowRequestThreshold,
+		captureSlowRequests:        options.CaptureSlowRequests,
+		attachRuntimeStatsOnPanic:  options.AttachRuntimeStatsOnPanic,
+		normalizeBaggage:           options.NormalizeBaggage,
+		treatClientErrorsAsOK:      options.TreatClientErrorsAsOK,
+		tagReferer:                 options.TagReferer,
+		tagOrigin:                  options.TagOrigin,
+		tagHost:                    options.TagHost,
+		tagAcceptLanguage:          options.TagAcceptLanguage,
+		emptyPathName:              options.EmptyPathName,
+		tagClientCertSubject:       options.TagClientCertSubject,
+		tagTLSInfo:                 options.TagTLSInfo,
+		apiVersion:                 options.APIVersion,
+		standardAttributes:         options.StandardAttributes,
+		ignorePaths:                ignorePaths,
+		ignorePrefixes:             options.IgnorePrefixes,
+		ignorePathRegexps:          options.IgnorePathRegexps,
+		skipMethods:                options.SkipMethods,
+		nestedTransactionPolicy:    options.NestedTransactionPolicy,
+		environmentFromHost:        options.EnvironmentFromHost,
+		nameNormalizer:             options.NameNormalizer,
+		echoTraceHeader:            options.EchoTraceHeader,
+		onPanic:                    options.OnPanic,
+		buildInfoTags:              buildInfo,
+		maxEventDataBytes:          options.MaxEventDataBytes,
+		hierarchicalRouteTags:      options.HierarchicalRouteTags,
+		countChildSpansByOp:        options.CountChildSpansByOp,
+		requestTiming:              options.RequestTiming,
+		maxResponseBodyCapture:     options.MaxResponseBodyCapture,
+		spanOptions:                options.SpanOptions,
+		spanOptionsFunc:            options.SpanOptionsFunc,
+		claimsTagger:               options.ClaimsTagger,
+		deferredFinishTimeout:      deferredFinishTimeout,
+		transactionNameHeader:      options.TransactionNameHeader,
+		stripTransactionNameHeader: options.StripTransactionNameHeader,
+		alwaysSampleErrors:         options.AlwaysSampleErrors,
+		skipCanceledRequests:       options.SkipCanceledRequests,
+		setTransactionDescription:  options.SetTransactionDescription,
+		lowMemoryPanicReport:       options.LowMemoryPanicReport,
+		recordSampleRate:           options.RecordSampleRate,
+		metricsObserver:            options.MetricsObserver,
+		notFoundStatus:             options.NotFoundStatus,
+		hubProvider:                options.HubProvider,
+		cacheStatusHeader:          options.CacheStatusHeader,
+		emitTraceResponse:          options.EmitTraceResponse,
+		routingSpan:                options.RoutingSpan,
+		recordDeadline:             options.RecordDeadline,
+		sanitizeURLNames:           options.SanitizeURLNames,
+		externalTraceIDHeader:      options.ExternalTraceIDHeader,
+		externalTraceTagName:       externalTraceTagName,
+		latencyBuckets:             latencyBuckets,
+		captureOnlyWhenSampled:     options.CaptureOnlyWhenSampled,
+		accessLogger:               options.AccessLogger,
+		minimalRequestCapture:      options.MinimalRequestCapture,
+		routeName:                  options.RouteName,
+		maxBreadcrumbs:             options.MaxBreadcrumbs,
+		cohortFromRequest:          options.CohortFromRequest,
+		initialTransactionName:     options.InitialTransactionName,
+		cronMonitor:                options.CronMonitor,
+		maxRequestBodySize:         options.MaxRequestBodySize,
+		traceContextData:           options.TraceContextData,
+		queueStartHeader:           options.QueueStartHeader,
+		tagCacheValidators:         options.TagCacheValidators,
+		captureDeadlineExceeded:    options.CaptureDeadlineExceeded,
+		now:                        time.Now,
 	}
 }
 
+// isTestBinary reports whether the program is a test binary built by go test.
+func isTestBinary() bool {
+	return flag.Lookup("test.v") != nil
+}
+
+// Default returns a new Handler using the default Options.
+//
+// The returned Handler neither repanics, nor waits for the delivery of panic
+// events.
+// It is meant to get started quickly, serious deployments should use New and
+// configure the Options to their needs.
+func Default() *Handler {
+	return New(Options{})
+}
+
+var (
+	defaultHandler     *Handler
+	defaultHandlerOnce sync.Once
+)
+
+// Handle wraps handler using a Handler with the default Options, as returned
+// by Default.
+//
+// It can be used directly as a chi middleware:
+//
+//	r.Use(chisentry.Handle)
+func Handle(handler http.Handler) http.Handler {
+	defaultHandlerOnce.Do(func() { defaultHandler = Default() })
+	return defaultHandler.Handle(handler)
+}
+
+// WrapHandler wraps handler using a Handler with the passed options, allowing
+// to configure the instrumentation of a single route differently, e.g.:
+//
+//	r.Use(h.Handle)
+//	r.Method(http.MethodPost, "/upload", chisentry.WrapHandler(http.HandlerFunc(upload), chisentry.Options{
+//		CaptureSlowRequests:  true,
+//		SlowRequestThreshold: 30 * time.Second,
+//	}))
+//
+// If the request was already traced by an outer Handler, options'
+// NestedTransactionPolicy decides what happens:
+//
+//   - NestedTransactionAdopt, the default, hands the transaction over: The
+//     options are applied to the transaction of the outer Handler, which is
+//     finished by the Handler of WrapHandler, and timed from when the outer
+//     Handler received the request.
+//     The outer Handler then doesn't finish the transaction itself, so that
+//     e.g. its MetricsObserver and AccessLogger aren't called for the
+//     request.
+//     Options implemented by event processors, such as
+//     MaxResponseBodyCapture, only take effect, if the outer Handler uses a
+//     different hub, as documented for Options.NestedTransactionPolicy.
+//   - NestedTransactionChild traces the request in a child span of the
+//     outer transaction, which is still finished by the outer Handler.
+//   - NestedTransactionSkip leaves the request to the outer Handler, only
+//     recovering from panics.
+//
+// Panics are recovered from by the Handler of WrapHandler, and only reach
+// the outer Handler, if it repanics.
+func WrapHandler(handler http.Handler, options Options) http.Handler {
+	return New(options).Handle(handler)
+}
+
 // Handle works as a middleware that wraps an existing http.Handler. A wrapped
 // handler will recover from and report panics to Sentry, and provide access to
 // a request-specific hub to report messages and errors.
+//
+// If a handler panics with an error, the errors of its Unwrap chain are
+// reported as chained exceptions, so that the root cause is visible.
+// The length of the chain is limited by sentry.ClientOptions.MaxErrorDepth.
+//
+// If a handler calls runtime.Goexit, its transaction is finished with the
+// internal_error status and tagged with abnormal_exit.
+//
+// The transactions of wrapped handlers are named after the method and the
+// matched route pattern of the request, e.g. "GET /users/{id}", so that
+// requests to the same route with different methods are kept apart.
+//
+// Transactions of requests answered with 405 Method Not Allowed are tagged
+// with route.method_not_allowed, so that they can be told apart from other
+// client errors.
+// If the response has an Allow header, as set by custom MethodNotAllowed
+// handlers, its value is stored in the transaction's http.allow data.
+//
+// The http.ResponseWriter passed to the wrapped handler is chi's
+// middleware.WrapResponseWriter, which only forwards certain combinations of
+// the optional interfaces implemented by the original writer:
+//
+//   - HTTP/2: http.Flusher, and http.Pusher only if http.Flusher is also
+//     implemented.
+//   - HTTP/1.x: http.Flusher and http.Hijacker, each on its own, and
+//     io.ReaderFrom only if both http.Flusher and http.Hijacker are also
+//     implemented.
+//
+// The wrapped writer never implements an optional interface the original
+// writer doesn't, unless Options.StripTransactionNameHeader is set.
+// In that case, it implements all of them, but falls back to a no-op or an
+// error, if the original writer doesn't implement them.
+// Additionally, it provides an Unwrap method returning the original writer,
+// which is used by http.ResponseController to reach the methods of the
+// original writer that aren't forwarded.
+// Headers, including trailers, are written to the original writer directly.
 func (h *Handler) Handle(handler http.Handler) http.Handler {
 	return h.handle(handler)
 }
@@ -109,65 +1165,1031 @@ func (h *Handler) HandleFunc(handler http.HandlerFunc) http.HandlerFunc {
 
 func (h *Handler) handle(handler http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if h.skipCanceledRequests && r.Context().Err() != nil {
+			return
+		}
+		if h.isIgnored(r) || !h.inFlight.add() {
+			h.handleIgnored(handler, w, r)
+			return
+		}
+
+		start := h.now()
+		// Record whether upgrade requests are hijacked, so that we know
+		// whether the upgrade succeeded, even though no status is written.
+		var hijack *hijackRecorder
+		if _, ok := w.(http.Hijacker); ok && r.ProtoMajor == 1 && r.Header.Get("Upgrade") != "" {
+			w, hijack = newHijackRecorder(w)
+		}
+		var nameHeader *headerStripper
+		if h.transactionNameHeader != "" && h.stripTransactionNameHeader {
+			nameHeader = newHeaderStripper(w, h.transactionNameHeader)
+			w = nameHeader
+		}
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 
+		state := &requestState{
+			ctx:        r.Context(),
+			ww:         ww,
+			r:          r,
+			start:      start,
+			hijack:     hijack,
+			nameHeader: nameHeader,
+		}
+		// The deferred functions are installed before any of the options'
+		// callbacks are called, so that panics in them are reported as
+		// well, and the request is always removed from the in-flight
+		// requests.
+		state.finish = func() {
+			defer h.inFlight.release()
+			if state.transaction != nil && !state.isHandedOff() {
+				h.finishTransaction(state)
+			}
+		}
+		defer state.finishAfterHandler(h.deferredFinishTimeout, h.snapshotResponse)
+		// If the handler neither returned nor panicked, it called
+		// runtime.Goexit, which can't be recovered from.
+		returned := false
+		defer func() {
+			if !returned && !state.hasPanicked() {
+				state.mu.Lock()
+				state.exitedAbnormally = true
+				state.mu.Unlock()
+			}
+		}()
+		// Since this is deferred before the handler is called, it also
+		// recovers from panics in the handler's own deferred functions,
+		// which run before ServeHTTP returns.
+		defer h.recoverRequest(state)
+
 		ctx := r.Context()
-		hub := sentry.GetHubFromContext(ctx)
-		if hub == nil {
-			hub = sentry.CurrentHub().Clone()
-			ctx = sentry.SetHubOnContext(ctx, hub)
+		hub, ctx := h.requestHub(ctx, r)
+		state.hub = hub
+		state.lastEventID = hub.LastEventID()
+
+		// If an outer Handler already handles the request using the same
+		// hub, it also already added its event processors to the scope.
+		// Adding ours as well would run them twice for every event.
+		outer := requestStateFromContext(ctx)
+		addEventProcessors := outer == nil || outer.hub != hub
+		if !addEventProcessors {
+			state.outer = outer
 		}
-		options := []sentry.SpanOption{
-			sentry.OpName("http.server"),
-			sentry.ContinueFromRequest(r),
-			sentry.TransctionSource(sentry.SourceURL),
-		}
-		// We don't mind getting an existing transaction back so we don't need to
-		// check if it is.
-		//
-		// Leave the transaction name as r.URL.Path, in case we panic before
-		// the routing is finished and only update it after we called
+		adopt := outer != nil && h.nestedTransactionPolicy == NestedTransactionAdopt
+		if adopt {
+			// We adopt the transaction of the outer Handler, so we finish it
+			// in its stead, along with the spans and check-ins it started.
+			// The request is still timed from when the outer Handler
+			// received it.
+			outer.mu.Lock()
+			outer.handedOff = true
+			outer.mu.Unlock()
+			state.start = outer.start
+			state.routingSpan, state.cronCheckIn = outer.routingSpan, outer.cronCheckIn
+		}
+		ctx = context.WithValue(ctx, requestStateKey{}, state)
+
+		// Use r.URL.Path as the transaction name, in case we panic before
+		// the routing is finished, and only update it after we called
 		// handler.ServerHTTP.
-		transaction := sentry.StartTransaction(ctx, r.URL.Path, options...)
-		defer transaction.Finish()
-		// TODO(tracing): if the next handler.ServeHTTP panics, store
-		// information on the transaction accordingly (status, tag,
-		// level?, ...).
-		*r = *r.WithContext(transaction.Context())
-		hub.Scope().SetRequest(r)
-		defer h.recoverWithSentry(hub, r)
-		// TODO(tracing): use custom response writer to intercept
-		// response. Use HTTP status to add tag to transaction; set span
-		// status.
+		// If we have a router, we can resolve the route pattern up front, so
+		// that events captured before routing is finished are already
+		// grouped correctly.
+		name, source := r.URL.Path, sentry.SourceURL
+		if h.initialTransactionName != "" {
+			name, source = h.initialTransactionName, sentry.SourceCustom
+		} else if name == "" {
+			// This can happen for malformed requests or CONNECT requests.
+			name = h.emptyPathName
+			if name == "" {
+				name = r.Method + " <unknown>"
+			}
+		}
+		if routePattern := h.matchRoute(r); routePattern != "" {
+			name, source = r.Method+" "+routePattern, sentry.SourceRoute
+		}
+
+		continueFromRequest := sentry.ContinueFromRequest(r)
+		if h.normalizeBaggage {
+			continueFromRequest = sentry.ContinueFromHeaders(
+				r.Header.Get("sentry-trace"), normalizeBaggage(r.Header.Values("baggage")),
+			)
+		}
+
+		options := []sentry.SpanOption{
+			sentry.WithOpName("http.server"),
+			continueFromRequest,
+			sentry.WithTransactionSource(source),
+		}
+		options = append(options, h.spanOptions...)
+		if h.spanOptionsFunc != nil {
+			options = append(options, h.spanOptionsFunc(r)...)
+		}
+		var transaction *sentry.Span
+		if h.nestedTransactionPolicy == NestedTransactionChild && sentry.TransactionFromContext(ctx) != nil {
+			// Leave the existing transaction alone, and trace the request
+			// in a span of its own.
+			transaction = sentry.StartSpan(ctx, "http.server")
+			transaction.Description = name
+		} else {
+			// If there is an existing transaction, we get it back and adopt
+			// it.
+			transaction = sentry.StartTransaction(ctx, name, options...)
+			// Attach the name of the transaction to the other events of the
+			// request, so that they are grouped by route as well.
+			if addEventProcessors {
+				hub.Scope().AddEventProcessor(func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+					if event.Type != "transaction" && event.Transaction == "" {
+						event.Transaction = transaction.Name
+					}
+					return event
+				})
+			}
+		}
+		state.transaction = transaction
+		if h.standardAttributes {
+			setPeerData(transaction, r.RemoteAddr)
+		}
+		if h.externalTraceIDHeader != "" {
+			if id := r.Header.Get(h.externalTraceIDHeader); id != "" {
+				transaction.SetTag(h.externalTraceTagName, id)
+			}
+		}
+		if h.queueStartHeader != "" {
+			if queueStart, ok := parseQueueStart(r.Header.Get(h.queueStartHeader)); ok {
+				startQueueSpan(transaction, queueStart, start)
+			}
+		}
+		if h.recordDeadline {
+			if deadline, ok := r.Context().Deadline(); ok {
+				setData(transaction, "http.request.deadline_ms", deadline.Sub(start).Milliseconds())
+			}
+		}
+		if h.echoTraceHeader {
+			ww.Header().Set("sentry-trace", transaction.ToSentryTrace())
+		}
+		if h.emitTraceResponse {
+			ww.Header().Set("traceresponse", traceResponse(transaction))
+		}
+		if adopt {
+			// The context of an adopted transaction is that of the outer
+			// Handler, which lacks our state.
+			// ctx holds both.
+			*r = *r.WithContext(ctx)
+		} else {
+			*r = *r.WithContext(transaction.Context())
+		}
+		if h.contextFunc != nil {
+			*r = *r.WithContext(h.contextFunc(r.Context(), r))
+		}
+		capture := !h.captureOnlyWhenSampled || transaction.Sampled.Bool()
+		if capture && !h.disableRequestCapture {
+			switch {
+			case h.minimalRequestCapture:
+				if addEventProcessors {
+					hub.Scope().AddEventProcessor(minimalRequest(r, state))
+				}
+			case h.requestTiming == RequestTimingEarly:
+				hub.Scope().SetRequest(r)
+			case h.requestTiming == RequestTimingLate:
+				// Convert the request now, since the handler may modify r,
+				// and r must not be used after the handler returned.
+				request := sentry.NewRequest(r)
+				if addEventProcessors {
+					hub.Scope().AddEventProcessor(func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+						if event.Type == "transaction" {
+							event.Request = request
+						}
+						return event
+					})
+				}
+			}
+		}
+		if len(h.buildInfoTags) > 0 {
+			hub.Scope().SetTags(h.buildInfoTags)
+		}
+		if capture && len(h.captureCookies) > 0 && addEventProcessors {
+			h.setCookies(hub, r)
+		}
+		if h.tagReferer {
+			setTruncatedTag(hub.Scope(), "http.referer", r.Header.Get("Referer"))
+		}
+		if h.tagOrigin {
+			setTruncatedTag(hub.Scope(), "http.origin", r.Header.Get("Origin"))
+		}
+		if h.tagHost {
+			setTruncatedTag(hub.Scope(), "http.host", r.Host)
+		}
+		if h.tagAcceptLanguage {
+			setTruncatedTag(hub.Scope(), "locale", preferredLanguage(r.Header.Get("Accept-Language")))
+		}
+		if h.tagClientCertSubject && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			setTruncatedTag(hub.Scope(), "tls.client_subject", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		if h.tagTLSInfo && r.TLS != nil {
+			hub.Scope().SetTag("tls.version", tlsVersionName(r.TLS.Version))
+			hub.Scope().SetTag("tls.cipher_suite", tls.CipherSuiteName(r.TLS.CipherSuite))
+		}
+		if h.apiVersion != nil {
+			setTruncatedTag(hub.Scope(), "api.version", h.apiVersion(r))
+		}
+		if h.claimsTagger != nil {
+			hub.Scope().SetTags(h.claimsTagger(r))
+		}
+		if h.traceContextData != nil {
+			if data := h.traceContextData(r); len(data) > 0 {
+				hub.Scope().AddEventProcessor(addTraceContextData(transaction, data))
+			}
+		}
+		if h.cohortFromRequest != nil {
+			setTruncatedTag(hub.Scope(), "cohort", h.cohortFromRequest(r))
+		}
+		if h.environmentFromHost != nil {
+			setEnvironment(hub.Scope(), h.environmentFromHost(r.Host))
+		}
+		if h.extrasFromContext != nil {
+			hub.Scope().SetExtras(h.extrasFromContext(r.Context()))
+		}
+		if capture && h.maxResponseBodyCapture > 0 {
+			buf := newResponseBodyBuffer(ww, h.maxResponseBodyCapture)
+			ww.Tee(buf)
+			hub.Scope().AddEventProcessor(buf.eventProcessor())
+		}
+		if h.countChildSpansByOp {
+			hub.Scope().AddEventProcessor(countSpansByOp)
+		}
+		if addEventProcessors {
+			hub.Scope().AddEventProcessor(state.dropDisabledBreadcrumbs)
+		}
+		if h.maxBreadcrumbs > 0 && addEventProcessors {
+			hub.Scope().AddEventProcessor(limitBreadcrumbs(h.maxBreadcrumbs))
+		}
+		// This must be the last event processor we add, so that it sees the
+		// final event.
+		if h.maxEventDataBytes > 0 {
+			hub.Scope().AddEventProcessor(limitEventData(h.maxEventDataBytes))
+		}
+		if h.maxRequestBodySize > 0 {
+			if r.ContentLength > h.maxRequestBodySize {
+				transaction.SetTag("rejected.reason", "body_too_large")
+				ww.WriteHeader(http.StatusRequestEntityTooLarge)
+				returned = true
+				return
+			}
+			r.Body = http.MaxBytesReader(ww, r.Body, h.maxRequestBodySize)
+		}
+		if h.cronMonitor != nil && state.cronCheckIn == nil {
+			if slug, ok := h.cronMonitor(r); ok {
+				state.cronCheckIn = startCronCheckIn(hub, slug)
+			}
+		}
+		if h.routingSpan && state.routingSpan == nil {
+			state.routingSpan = sentry.StartSpan(transaction.Context(), "http.route")
+			restoreTraceContext(transaction)
+		}
 		handler.ServeHTTP(ww, r)
+		returned = true
+	}
+}
+
+// requestHub returns the hub used for r, and ctx with the hub stored in it.
+func (h *Handler) requestHub(ctx context.Context, r *http.Request) (*sentry.Hub, context.Context) {
+	if h.hubProvider != nil {
+		if hub := h.hubProvider(r); hub != nil {
+			if client := hub.Client(); client != nil {
+				h.providedClients.Store(client, struct{}{})
+			}
+			return hub, sentry.SetHubOnContext(ctx, hub)
+		}
+	}
+
+	if hub := sentry.GetHubFromContext(ctx); hub != nil {
+		return hub, ctx
+	}
+
+	// The hub must be cloned even if the request's scope isn't modified by
+	// us, since starting a transaction sets the trace context on the scope
+	// of the hub, which would otherwise bleed into concurrent requests.
+	hub := sentry.CurrentHub().Clone()
+	return hub, sentry.SetHubOnContext(ctx, hub)
+}
+
+// isIgnored reports whether r should not be traced.
+func (h *Handler) isIgnored(r *http.Request) bool {
+	if h.nestedTransactionPolicy == NestedTransactionSkip && sentry.TransactionFromContext(r.Context()) != nil {
+		return true
+	}
 
-		transaction.Status = httpStatusToSentryStatus(ww.Status())
+	for _, method := range h.skipMethods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	if _, ok := h.ignorePaths[r.URL.Path]; ok {
+		return true
+	}
+	for _, prefix := range h.ignorePrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	for _, re := range h.ignorePathRegexps {
+		if re.MatchString(r.URL.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleIgnored handles a request that is not traced.
+// Panics are still recovered from and reported.
+func (h *Handler) handleIgnored(handler http.Handler, w http.ResponseWriter, r *http.Request) {
+	// Like for traced requests, we recover before calling HubProvider,
+	// falling back to a clone of the current hub if it panicked.
+	var hub *sentry.Hub
+	defer func() {
+		if err := recover(); err != nil {
+			if hub == nil {
+				hub = sentry.CurrentHub().Clone()
+			}
+			h.handlePanic(hub, w, r, err)
+		}
+	}()
+
+	hub, ctx := h.requestHub(r.Context(), r)
+	*r = *r.WithContext(ctx)
+	if !h.disableRequestCapture {
+		if h.minimalRequestCapture {
+			hub.Scope().AddEventProcessor(minimalRequest(r, nil))
+		} else if h.requestTiming == RequestTimingEarly {
+			hub.Scope().SetRequest(r)
+		}
+	}
+	if len(h.buildInfoTags) > 0 {
+		hub.Scope().SetTags(h.buildInfoTags)
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+// finishTransaction names the transaction of the request after the matched
+// route, sets its status and finishes it.
+func (h *Handler) finishTransaction(state *requestState) {
+	transaction, r := state.transaction, state.r
+
+	if state.routingSpan != nil {
+		state.routingSpan.Finish()
+	}
+
+	snapshot := state.loadSnapshot()
+	if snapshot == nil {
+		snapshot = h.snapshotResponse(state)
+		state.mu.Lock()
+		state.snapshot = snapshot
+		state.mu.Unlock()
+	}
+
+	routeMethod, routePattern := snapshot.routeMethod, snapshot.routePattern
+	if h.hierarchicalRouteTags && routePattern != "" {
+		setRouteTags(transaction, snapshot.routePatterns, routePattern)
+	}
+
+	httpStatus := snapshot.status
+	if h.notFoundStatus && httpStatus == 0 && routePattern == "" && !state.hasPanicked() {
+		httpStatus = http.StatusNotFound
+	}
+	if httpStatus != 0 {
+		setData(transaction, "http.status_code", httpStatus)
+	}
+
+	if status, ok := state.explicitStatus(); ok {
+		transaction.Status = status
+	} else if state.hasPanicked() {
+		transaction.Status = sentry.SpanStatusInternalError
+	} else if state.hasExitedAbnormally() {
+		transaction.Status = sentry.SpanStatusInternalError
+		transaction.SetTag("abnormal_exit", "true")
+	} else if h.treatClientErrorsAsOK && httpStatus >= 200 && httpStatus < 500 {
+		transaction.Status = sentry.SpanStatusOK
+	} else {
+		transaction.Status = httpStatusToSentryStatus(httpStatus)
+	}
+	transaction.SetTag("http.method", r.Method)
+	if h.tagCacheValidators {
+		setCacheValidators(transaction, snapshot.header, httpStatus)
+	}
+	if h.routeName != nil && routePattern != "" {
+		if name := h.routeName(routePattern, r.Method); name != "" {
+			transaction.SetTag("route.name", name)
+		}
+	}
+	if h.cacheStatusHeader != "" {
+		if cacheStatus := snapshot.header.Get(h.cacheStatusHeader); cacheStatus != "" {
+			transaction.SetTag("cache.status", cacheStatus)
+		}
+	}
+	if httpStatus == http.StatusMethodNotAllowed {
+		transaction.SetTag("route.method_not_allowed", "true")
+		if allow := snapshot.header.Get("Allow"); allow != "" {
+			setData(transaction, "http.allow", allow)
+		}
+	}
+
+	// If the route pattern is empty, the request never reached the router,
+	// e.g. because a middleware already responded, or didn't match a
+	// route.
+	// Keep the initial name in that case.
+	if routePattern != "" {
+		if transaction.IsTransaction() {
+			transaction.Name = routeMethod + " " + routePattern
+			transaction.Source = sentry.SourceRoute
+		} else {
+			transaction.Description = routeMethod + " " + routePattern
+		}
+	}
+	if h.setTransactionDescription && transaction.IsTransaction() {
+		if routePattern != "" {
+			transaction.Description = routePattern
+		} else {
+			transaction.Description = r.URL.Path
+		}
+	}
+	if h.transactionNameHeader != "" && transaction.IsTransaction() {
+		if name := snapshot.header.Get(h.transactionNameHeader); name != "" {
+			transaction.Name = name
+			transaction.Source = sentry.SourceCustom
+		}
+	}
+	if h.sanitizeURLNames && transaction.IsTransaction() && transaction.Source == sentry.SourceURL {
+		transaction.Name = SanitizeIDs(transaction.Name)
+	}
+	if h.nameNormalizer != nil && transaction.IsTransaction() {
+		transaction.Name = h.nameNormalizer(transaction.Name)
+	}
+
+	end, hasEndTime := state.explicitEndTime()
+	if hasEndTime {
+		transaction.EndTime = end
+	} else {
+		end = h.now()
+	}
+	duration := end.Sub(state.start)
+	if len(h.latencyBuckets) > 0 {
+		transaction.SetTag("latency_bucket", latencyBucket(h.latencyBuckets, duration))
+	}
+	if h.accessLogger != nil {
+		logAccess(h.accessLogger, transaction, r, routePattern, httpStatus, duration, state.hasPanicked())
+	}
+	if state.cronCheckIn != nil {
+		state.cronCheckIn.finish(state.hub, cronFailed(state, httpStatus), duration)
+	}
+	if h.metricsObserver != nil {
+		h.metricsObserver.Observe(routePattern, r.Method, httpStatus, duration)
+	}
+
+	if state.isSkipped() {
+		transaction.Sampled = sentry.SampledFalse
+	} else {
+		if h.tailSampler != nil && transaction.Sampled.Bool() &&
+			!h.tailSampler(httpStatus, duration, routePattern) {
+			transaction.Sampled = sentry.SampledFalse
+		}
+		if h.captureDeadlineExceeded && errors.Is(state.ctx.Err(), context.DeadlineExceeded) &&
+			state.hub.LastEventID() == state.lastEventID {
+			captureDeadlineExceeded(state.hub, transaction.Name, routePattern, duration)
+		}
+		if h.captureSlowRequests && h.slowRequestThreshold > 0 && duration > h.slowRequestThreshold {
+			captureSlowRequest(state.hub, transaction.Name, routePattern, duration, httpStatus)
+		}
+		if h.alwaysSampleErrors && (state.hasPanicked() || httpStatus >= http.StatusInternalServerError) {
+			transaction.Sampled = sentry.SampledTrue
+		}
+	}
+
+	if h.recordSampleRate && transaction.IsTransaction() {
+		setSampleRate(transaction)
+	}
+	for key, value := range state.loadMeasurements() {
+		setData(transaction, key, value)
+	}
+	for key, value := range state.loadTags() {
+		transaction.SetTag(key, value)
+	}
+
+	transaction.Finish()
+
+	if h.flushOnResponse {
+		state.hub.Flush(h.timeout)
+	}
+}
+
+// snapshotResponse takes a snapshot of the routing result and the response of
+// the request with the passed state.
+func (h *Handler) snapshotResponse(state *requestState) *responseSnapshot {
+	snapshot := &responseSnapshot{
+		status: responseStatus(state.ww, state.r, state.hijack.wasHijacked()),
+		header: make(http.Header),
+	}
+	if rctx := chi.RouteContext(state.r.Context()); rctx != nil {
+		snapshot.routeMethod, snapshot.routePattern = rctx.RouteMethod, rctx.RoutePattern()
+		snapshot.routePatterns = append([]string(nil), rctx.RoutePatterns...)
+	}
+
+	header := state.ww.Header()
+	names := [...]string{"Allow", "ETag", "Last-Modified", h.transactionNameHeader, h.cacheStatusHeader}
+	for _, name := range names {
+		if name != "" && header.Get(name) != "" {
+			snapshot.header.Set(name, header.Get(name))
+		}
+	}
+	if state.nameHeader != nil {
+		snapshot.header.Set(h.transactionNameHeader, state.nameHeader.value())
+	}
+
+	return snapshot
+}
+
+// setRouteTags sets the route.l<n> tags for each of the patterns of the
+// (sub)routers a request was routed through, and the route.full tag for the
+// full route pattern.
+func setRouteTags(transaction *sentry.Span, routePatterns []string, fullPattern string) {
+	for i, p := range routePatterns {
+		p = strings.TrimSuffix(p, "/*")
+		if p == "" {
+			p = "/"
+		}
+		transaction.SetTag("route.l"+strconv.Itoa(i+1), p)
+	}
+	transaction.SetTag("route.full", fullPattern)
+}
+
+// captureSlowRequest captures a warning about a request that took longer
+// than the configured threshold.
+func captureSlowRequest(hub *sentry.Hub, name, routePattern string, duration time.Duration, status int) {
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetLevel(sentry.LevelWarning)
+		scope.SetExtras(map[string]interface{}{
+			"route":       routePattern,
+			"duration":    duration.String(),
+			"http.status": status,
+		})
+		hub.CaptureMessage(fmt.Sprintf("Slow request: %s took %s", name, duration))
+	})
+}
+
+// captureDeadlineExceeded captures a warning about a request that exceeded
+// the deadline of its context.
+func captureDeadlineExceeded(hub *sentry.Hub, name, routePattern string, duration time.Duration) {
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetLevel(sentry.LevelWarning)
+		scope.SetExtras(map[string]interface{}{
+			"route":    routePattern,
+			"duration": duration.String(),
+		})
+		hub.CaptureMessage(fmt.Sprintf("Deadline exceeded: %s took %s", name, duration))
+	})
+}
+
+// minimalRequest returns an event processor that adds a compact description
+// of r to the http context of events.
+// If state is not nil, the description includes the status written to the
+// response.
+//
+// Once the handler returned, the route and status are taken from the
+// snapshot of the response, since neither the route context nor the response
+// writer may be used anymore.
+func minimalRequest(r *http.Request, state *requestState) sentry.EventProcessor {
+	// Copy these now, since the handler may modify r.
+	method, host, path := r.Method, r.Host, r.URL.Path
+
+	return func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+		info := map[string]interface{}{
+			"method": method,
+			"host":   host,
+			"path":   path,
+		}
+
+		var snapshot *responseSnapshot
+		if state != nil {
+			snapshot = state.loadSnapshot()
+		}
+
+		var pattern string
+		var status int
+		if snapshot != nil {
+			pattern, status = snapshot.routePattern, snapshot.status
+		} else {
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				pattern = rctx.RoutePattern()
+			}
+			if state != nil {
+				status = state.ww.Status()
+			}
+		}
+		if pattern != "" {
+			info["route"] = pattern
+		}
+		if status != 0 {
+			info["status_code"] = status
+		}
+
+		if event.Contexts == nil {
+			event.Contexts = make(map[string]sentry.Context)
+		}
+		event.Contexts["http"] = info
+		return event
+	}
+}
+
+// setCookies attaches the cookies of r that are listed in h.captureCookies to
+// the events captured by hub, and removes all other cookies from them.
+func (h *Handler) setCookies(hub *sentry.Hub, r *http.Request) {
+	var b strings.Builder
+	for _, c := range r.Cookies() {
+		if _, ok := h.captureCookies[c.Name]; !ok {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(c.String())
+	}
+	cookies := b.String()
+
+	if h.disableRequestCapture {
+		if cookies != "" {
+			hub.Scope().SetExtra("cookies", cookies)
+		}
+		return
+	}
+
+	hub.Scope().AddEventProcessor(func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+		if event.Request != nil {
+			event.Request.Cookies = cookies
+			delete(event.Request.Headers, "Cookie")
+		}
+		return event
+	})
+}
+
+// setData sets the data with the passed key on span.
+func setData(span *sentry.Span, key string, value interface{}) {
+	if span.Data == nil {
+		span.Data = make(map[string]interface{})
+	}
+	span.Data[key] = value
+}
+
+// restoreTraceContext sets the trace context of the scope of span's hub back
+// to that of span.
+//
+// sentry.StartSpan sets the trace context to that of the started span, so
+// this must be called after starting spans on behalf of the request, so that
+// events captured during the request still reference its transaction.
+func restoreTraceContext(span *sentry.Span) {
+	hub := sentry.GetHubFromContext(span.Context())
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+
+	hub.Scope().SetContext("trace", sentry.TraceContext{
+		TraceID:      span.TraceID,
+		SpanID:       span.SpanID,
+		ParentSpanID: span.ParentSpanID,
+		Op:           span.Op,
+		Description:  span.Description,
+		Status:       span.Status,
+	}.Map())
+}
+
+// traceResponse returns the value of the W3C traceresponse header for span.
+func traceResponse(span *sentry.Span) string {
+	flags := "00"
+	if span.Sampled.Bool() {
+		flags = "01"
+	}
+	return "00-" + span.TraceID.String() + "-" + span.SpanID.String() + "-" + flags
+}
+
+// latencyBucket returns the name of the bucket of the sorted buckets, that d
+// falls into.
+func latencyBucket(buckets []time.Duration, d time.Duration) string {
+	if d < buckets[0] {
+		return "<" + buckets[0].String()
+	}
+	for i := 1; i < len(buckets); i++ {
+		if d < buckets[i] {
+			return buckets[i-1].String() + "-" + buckets[i].String()
+		}
+	}
+	return ">=" + buckets[len(buckets)-1].String()
+}
+
+// addTraceContextData returns an event processor that adds data to the data
+// field of the trace context of the event of transaction.
+func addTraceContextData(transaction *sentry.Span, data map[string]interface{}) sentry.EventProcessor {
+	return func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+		if event.Type != "transaction" {
+			return event
+		}
+
+		trace := event.Contexts["trace"]
+		if trace == nil || trace["span_id"] != transaction.SpanID {
+			return event
+		}
+
+		merged, _ := trace["data"].(map[string]interface{})
+		if merged == nil {
+			merged = make(map[string]interface{}, len(data))
+		}
+		for k, v := range data {
+			merged[k] = v
+		}
+		trace["data"] = merged
+		return event
+	}
+}
+
+// setCacheValidators stores the cache validators found in the response
+// header, and whether the response has the status 304 Not Modified, in the
+// data of transaction.
+func setCacheValidators(transaction *sentry.Span, header http.Header, status int) {
+	if etag := header.Get("ETag"); etag != "" {
+		setData(transaction, "http.response.etag", etag)
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		setData(transaction, "http.response.last_modified", lastModified)
+	}
+	if status == http.StatusNotModified {
+		setData(transaction, "http.response.not_modified", true)
+	}
+}
+
+// setSampleRate sets the sentry.sample_rate data of transaction to the sample
+// rate found in its dynamic sampling context.
+//
+// It must be called after the transaction was named, as it freezes the
+// dynamic sampling context, which includes the name.
+func setSampleRate(transaction *sentry.Span) {
+	dsc, err := sentry.DynamicSamplingContextFromHeader([]byte(transaction.ToBaggage()))
+	if err != nil {
+		return
+	}
 
-		rctx := chi.RouteContext(r.Context())
-		name := rctx.RouteMethod + " " + rctx.RoutePattern()
-		sentry.GetHubFromContext(transaction.Context()).Scope().SetTransaction(name)
+	rate, err := strconv.ParseFloat(dsc.Entries["sample_rate"], 64)
+	if err != nil {
+		return
 	}
+
+	setData(transaction, "sentry.sample_rate", rate)
 }
 
-func (h *Handler) recoverWithSentry(hub *sentry.Hub, r *http.Request) {
+// setPeerData sets the net.peer.ip and net.peer.port data on transaction,
+// extracted from remoteAddr.
+//
+// remoteAddr is parsed as follows:
+//
+//   - "1.2.3.4:80" and "[::1]:80" are split into the IP and the port, the
+//     latter without brackets
+//   - "1.2.3.4", "::1" and "[::1]" have no port, only net.peer.ip is set,
+//     without brackets
+func setPeerData(transaction *sentry.Span, remoteAddr string) {
+	if remoteAddr == "" {
+		return
+	}
+
+	ip, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		if strings.HasPrefix(remoteAddr, "[") && strings.HasSuffix(remoteAddr, "]") {
+			remoteAddr = remoteAddr[1 : len(remoteAddr)-1]
+		}
+		setData(transaction, "net.peer.ip", remoteAddr)
+		return
+	}
+
+	setData(transaction, "net.peer.ip", ip)
+	if port != "" {
+		setData(transaction, "net.peer.port", port)
+	}
+}
+
+// setEnvironment sets the environment of all events captured using scope to
+// env.
+// If env is empty, the environment configured in the client is kept.
+func setEnvironment(scope *sentry.Scope, env string) {
+	if env == "" {
+		return
+	}
+
+	scope.AddEventProcessor(func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+		event.Environment = env
+		return event
+	})
+}
+
+// countSpansByOp is an event processor that sets the spans.<op>_count data
+// on transactions, counting the spans of each op category, e.g.
+// spans.db_count for spans with the ops db and db.query.
+func countSpansByOp(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+	if event.Type != "transaction" || len(event.Spans) == 0 {
+		return event
+	}
+
+	counts := make(map[string]int)
+	for _, span := range event.Spans {
+		category := span.Op
+		if i := strings.IndexByte(category, '.'); i >= 0 {
+			category = category[:i]
+		}
+		if category != "" {
+			counts[category]++
+		}
+	}
+
+	if event.Extra == nil {
+		event.Extra = make(map[string]interface{}, len(counts))
+	}
+	for category, n := range counts {
+		event.Extra["spans."+category+"_count"] = n
+	}
+
+	return event
+}
+
+// maxTagValueLength is the maximum length of a tag value accepted by Sentry.
+const maxTagValueLength = 200
+
+// setTruncatedTag sets the tag with the passed key to value, truncating it to
+// maxTagValueLength, if necessary.
+// If the value is empty, no tag is set.
+func setTruncatedTag(scope *sentry.Scope, key, value string) {
+	if value == "" {
+		return
+	}
+
+	if len(value) > maxTagValueLength {
+		value = strings.ToValidUTF8(value[:maxTagValueLength], "")
+	}
+	scope.SetTag(key, value)
+}
+
+// preferredLanguage returns the first language tag of the passed
+// Accept-Language header value, ignoring its quality value.
+// It returns an empty string, if header is empty or malformed, or the first
+// language is the wildcard "*".
+func preferredLanguage(header string) string {
+	lang, _, _ := strings.Cut(header, ",")
+	lang, _, _ = strings.Cut(lang, ";")
+	lang = strings.TrimSpace(lang)
+
+	if lang == "" {
+		return ""
+	}
+	for _, c := range lang {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return lang
+}
+
+// tlsVersionName returns the name of the passed TLS version, e.g. "TLS 1.3".
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
+// matchRoute returns the route pattern h.router would route r to.
+// It returns "" if no router is configured or if r matches no route.
+func (h *Handler) matchRoute(r *http.Request) string {
+	if h.router == nil {
+		return ""
+	}
+
+	rctx := chi.NewRouteContext()
+	if !h.router.Match(rctx, r.Method, r.URL.Path) {
+		return ""
+	}
+	return rctx.RoutePattern()
+}
+
+// recoverRequest recovers from a panic during a traced request and handles
+// it.
+//
+// The steps are performed in the order documented in Options.OnPanic:
+// The panic is reported to Sentry, then the delivery of the event is waited
+// for, then OnPanic is called, and finally, the panic is repanicked.
+//
+// Since Go 1.21, panic(nil) causes recover to return a *runtime.PanicNilError,
+// so that such panics are handled like any other, unless the main module
+// declares an older Go version, or GODEBUG=panicnil=1 is set.
+//
+// Since it is deferred before the hub of the request is obtained, it falls
+// back to a clone of the current hub, if the panic occurred before that.
+func (h *Handler) recoverRequest(state *requestState) {
 	if err := recover(); err != nil {
-		eventID := hub.RecoverWithContext(
-			context.WithValue(r.Context(), sentry.RequestContextKey, r),
-			err,
-		)
+		state.mu.Lock()
+		state.panicked = true
+		state.mu.Unlock()
+
+		hub := state.hub
+		if hub == nil {
+			hub = sentry.CurrentHub().Clone()
+		}
+		h.handlePanic(hub, state.ww, state.r, err)
+	}
+}
+
+// handlePanic handles the panic err, which was recovered from.
+func (h *Handler) handlePanic(hub *sentry.Hub, w http.ResponseWriter, r *http.Request, err interface{}) {
+	if h.panicLimiter == nil || h.panicLimiter.allow(h.now()) {
+		// If the route pattern is still empty, routing hasn't finished
+		// yet, i.e. we panicked in a middleware.
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			hub.Scope().SetTag("panic.in_middleware", strconv.FormatBool(rctx.RoutePattern() == ""))
+		}
+		if h.attachRuntimeStatsOnPanic {
+			hub.Scope().SetContext("runtime_stats", runtimeStats())
+		}
+		var eventID *sentry.EventID
+		if h.lowMemoryPanicReport {
+			eventID = captureLowMemoryPanic(hub, r, err)
+		} else {
+			eventID = hub.RecoverWithContext(
+				context.WithValue(r.Context(), sentry.RequestContextKey, r),
+				err,
+			)
+		}
 		if eventID != nil && h.waitForDelivery {
-			hub.Flush(h.timeout)
+			hub.Flush(h.panicFlushTimeout)
 		}
-		if h.repanic {
-			panic(err)
+	}
+	if h.onPanic != nil {
+		h.onPanic(w, r, err)
+	}
+	if h.repanic {
+		panic(err)
+	}
+}
+
+// runtimeStats returns statistics about the Go runtime.
+func runtimeStats() sentry.Context {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return sentry.Context{
+		"goroutines":     runtime.NumGoroutine(),
+		"alloc":          m.Alloc,
+		"total_alloc":    m.TotalAlloc,
+		"sys":            m.Sys,
+		"heap_alloc":     m.HeapAlloc,
+		"heap_inuse":     m.HeapInuse,
+		"heap_objects":   m.HeapObjects,
+		"num_gc":         m.NumGC,
+		"gc_cpu_percent": m.GCCPUFraction * 100,
+	}
+}
+
+// responseStatus returns the status of the response written to ww.
+//
+// Connections hijacked to upgrade the protocol, e.g. to WebSocket, often
+// write the 101 Switching Protocols response to the hijacked connection
+// directly, so that ww never sees it.
+// If nothing was written to ww, r requests an upgrade, and the connection was
+// hijacked, responseStatus therefore assumes the upgrade succeeded and
+// returns 101.
+func responseStatus(ww middleware.WrapResponseWriter, r *http.Request, hijacked bool) int {
+	status := ww.Status()
+	if status != 0 || !hijacked || r.Header.Get("Upgrade") == "" {
+		return status
+	}
+
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return http.StatusSwitchingProtocols
+			}
 		}
 	}
+	return status
 }
 
 func httpStatusToSentryStatus(status int) sentry.SpanStatus {
 	// c.f. https://develop.sentry.dev/sdk/event-payloads/span/
 
-	if status >= 200 && status < 400 {
+	if status == http.StatusSwitchingProtocols || status >= 200 && status < 400 {
 		return sentry.SpanStatusOK
 	}
 
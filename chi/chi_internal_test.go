@@ -0,0 +1,175 @@
+package chi
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// newTracingHub returns a hub whose client samples every transaction, and
+// doesn't send any events.
+func newTracingHub(t *testing.T) *sentry.Hub {
+	t.Helper()
+
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		EnableTracing:    true,
+		TracesSampleRate: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sentry.NewHub(client, sentry.NewScope())
+}
+
+func TestHandler_Clock(t *testing.T) {
+	var duration time.Duration
+	h := New(Options{
+		TailSampler: func(_ int, d time.Duration, _ string) bool {
+			duration = d
+			return true
+		},
+	})
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	handler := h.HandleFunc(func(http.ResponseWriter, *http.Request) {
+		now = now.Add(150 * time.Millisecond)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(sentry.SetHubOnContext(r.Context(), newTracingHub(t)))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if expect := 150 * time.Millisecond; duration != expect {
+		t.Errorf("expected duration %s, got %s", expect, duration)
+	}
+}
+
+func TestHandler_AdoptedClock(t *testing.T) {
+	var duration time.Duration
+	outer := New(Options{})
+	inner := New(Options{
+		TailSampler: func(_ int, d time.Duration, _ string) bool {
+			duration = d
+			return true
+		},
+	})
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	outer.now = func() time.Time { return now }
+	inner.now = outer.now
+
+	handler := outer.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now = now.Add(100 * time.Millisecond)
+		inner.HandleFunc(func(http.ResponseWriter, *http.Request) {
+			now = now.Add(50 * time.Millisecond)
+		}).ServeHTTP(w, r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(sentry.SetHubOnContext(r.Context(), newTracingHub(t)))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if expect := 150 * time.Millisecond; duration != expect {
+		t.Errorf("expected duration %s, got %s", expect, duration)
+	}
+}
+
+// eventProcessors returns the number of event processors added to the scope
+// of hub.
+func eventProcessors(hub *sentry.Hub) int {
+	return reflect.ValueOf(hub.Scope()).Elem().FieldByName("eventProcessors").Len()
+}
+
+func TestHandler_NestedEventProcessors(t *testing.T) {
+	options := Options{CaptureCookies: []string{"session"}}
+
+	// serve serves a request using the handler returned by wrap, and returns
+	// the number of event processors on the scope of the request's hub, as
+	// seen by the innermost handler.
+	serve := func(wrap func(http.Handler) http.Handler) int {
+		var n int
+		handler := wrap(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			n = eventProcessors(sentry.GetHubFromContext(r.Context()))
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(sentry.SetHubOnContext(r.Context(), newTracingHub(t)))
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return n
+	}
+
+	expect := serve(New(options).Handle)
+	if expect == 0 {
+		t.Fatal("expected the Handler to add event processors")
+	}
+
+	outer, inner := New(options), New(options)
+	actual := serve(func(next http.Handler) http.Handler {
+		return outer.Handle(inner.Handle(next))
+	})
+	if actual != expect {
+		t.Errorf("expected %d event processors, but got %d", expect, actual)
+	}
+}
+
+func TestSetPeerData(t *testing.T) {
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		expectIP   interface{}
+		expectPort interface{}
+	}{
+		{name: "empty", remoteAddr: ""},
+		{name: "IPv4", remoteAddr: "1.2.3.4:80", expectIP: "1.2.3.4", expectPort: "80"},
+		{name: "IPv6", remoteAddr: "[::1]:80", expectIP: "::1", expectPort: "80"},
+		{name: "IPv4 without port", remoteAddr: "1.2.3.4", expectIP: "1.2.3.4"},
+		{name: "IPv6 without port", remoteAddr: "::1", expectIP: "::1"},
+		{name: "bracketed IPv6 without port", remoteAddr: "[::1]", expectIP: "::1"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			transaction := sentry.StartSpan(context.Background(), "http.server")
+
+			setPeerData(transaction, c.remoteAddr)
+
+			if ip := transaction.Data["net.peer.ip"]; ip != c.expectIP {
+				t.Errorf("expected net.peer.ip to be %v, but got %v", c.expectIP, ip)
+			}
+			if port := transaction.Data["net.peer.port"]; port != c.expectPort {
+				t.Errorf("expected net.peer.port to be %v, but got %v", c.expectPort, port)
+			}
+		})
+	}
+}
+
+func TestTLSVersionName(t *testing.T) {
+	testCases := []struct {
+		version uint16
+		expect  string
+	}{
+		{version: tls.VersionTLS10, expect: "TLS 1.0"},
+		{version: tls.VersionTLS11, expect: "TLS 1.1"},
+		{version: tls.VersionTLS12, expect: "TLS 1.2"},
+		{version: tls.VersionTLS13, expect: "TLS 1.3"},
+		{version: 0x0300, expect: "0x0300"},
+		{version: 0xABCD, expect: "0xABCD"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.expect, func(t *testing.T) {
+			if actual := tlsVersionName(c.version); actual != c.expect {
+				t.Errorf("expected %q, but got %q", c.expect, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,766 @@
+package chi_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/go-chi/chi/v5"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+	"github.com/mavolin/chi-sentry/chi/sentrytest"
+)
+
+// newRouter returns a router that uses a sentrytest.Handler created using
+// options, and the Recorder of the Handler.
+func newRouter(options chisentry.Options) (*chi.Mux, *sentrytest.Recorder) {
+	h, rec := sentrytest.New(options)
+
+	r := chi.NewRouter()
+	r.Use(h.Handle)
+	return r, rec
+}
+
+// discardTransport is a sentry.Transport that discards all events.
+type discardTransport struct{}
+
+func (discardTransport) Configure(sentry.ClientOptions) {}
+func (discardTransport) SendEvent(*sentry.Event)        {}
+func (discardTransport) Flush(time.Duration) bool       { return true }
+
+// serve serves a request with the passed method and target using handler,
+// and returns the recorded response.
+func serve(handler http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// onlyTransaction returns the only transaction recorded by rec, failing t if
+// there isn't exactly one.
+func onlyTransaction(t *testing.T, rec *sentrytest.Recorder) sentrytest.Transaction {
+	t.Helper()
+
+	ts := rec.Transactions()
+	if len(ts) != 1 {
+		t.Fatalf("expected 1 transaction, but got %d", len(ts))
+	}
+	return ts[0]
+}
+
+func TestHandler_HTTP2(t *testing.T) {
+	h := chisentry.New(chisentry.Options{})
+
+	var (
+		isPusher          bool
+		pushErr, origErr  error
+		origIsPusher      bool
+		handlerProtoMajor int
+	)
+
+	srv := httptest.NewUnstartedServer(h.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerProtoMajor = r.ProtoMajor
+
+		var pusher http.Pusher
+		if pusher, isPusher = w.(http.Pusher); isPusher {
+			pushErr = pusher.Push("/style.css", nil)
+		}
+
+		orig := w.(interface{ Unwrap() http.ResponseWriter }).Unwrap()
+		var origPusher http.Pusher
+		if origPusher, origIsPusher = orig.(http.Pusher); origIsPusher {
+			origErr = origPusher.Push("/style.css", nil)
+		}
+
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+	})))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ProtoMajor != 2 || handlerProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got HTTP/%d", resp.ProtoMajor)
+	}
+
+	if !origIsPusher {
+		t.Fatal("expected original writer to implement http.Pusher")
+	}
+	if !isPusher {
+		t.Fatal("expected wrapped writer to implement http.Pusher")
+	}
+	if pushErr != origErr {
+		t.Errorf("expected Push to return %v like the original writer, got %v", origErr, pushErr)
+	}
+
+	if string(body) != "body" {
+		t.Errorf("expected body %q, got %q", "body", body)
+	}
+	if v := resp.Trailer.Get("X-Checksum"); v != "abc" {
+		t.Errorf("expected trailer X-Checksum to be %q, got %q", "abc", v)
+	}
+}
+
+// countingObserver is a chisentry.MetricsObserver that counts the requests
+// it observes.
+type countingObserver struct{ n int }
+
+func (o *countingObserver) Observe(string, string, int, time.Duration) { o.n++ }
+
+func TestHandler_NestedTransactionPolicy(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy chisentry.NestedTransactionPolicy
+		// expectChild is whether the nested Handler traces the request in a
+		// child span.
+		expectChild bool
+		// expectOuter and expectInner are the number of times the
+		// MetricsObserver of the outer and the nested Handler are called.
+		expectOuter, expectInner int
+	}{
+		{name: "adopt", policy: chisentry.NestedTransactionAdopt, expectInner: 1},
+		{
+			name: "child", policy: chisentry.NestedTransactionChild,
+			expectChild: true, expectOuter: 1, expectInner: 1,
+		},
+		{name: "skip", policy: chisentry.NestedTransactionSkip, expectOuter: 1},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			var outer, inner countingObserver
+			r, rec := newRouter(chisentry.Options{MetricsObserver: &outer})
+			r.Method(http.MethodPost, "/upload", chisentry.WrapHandler(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					chisentry.SetTag(r.Context(), "upload", "true")
+					w.WriteHeader(http.StatusCreated)
+				}),
+				chisentry.Options{NestedTransactionPolicy: c.policy, MetricsObserver: &inner},
+			))
+
+			serve(r, http.MethodPost, "/upload")
+
+			if outer.n != c.expectOuter {
+				t.Errorf("expected outer MetricsObserver to be called %d times, but was called %d times",
+					c.expectOuter, outer.n)
+			}
+			if inner.n != c.expectInner {
+				t.Errorf("expected nested MetricsObserver to be called %d times, but was called %d times",
+					c.expectInner, inner.n)
+			}
+
+			transaction := onlyTransaction(t, rec)
+			if expect := "POST /upload"; transaction.Name != expect {
+				t.Errorf("expected name %q, but got %q", expect, transaction.Name)
+			}
+			if transaction.Status != sentry.SpanStatusOK {
+				t.Errorf("expected status %s, but got %s", sentry.SpanStatusOK, transaction.Status)
+			}
+
+			var child *sentry.Span
+			for _, span := range transaction.Spans {
+				if span.Op == "http.server" {
+					child = span
+				}
+			}
+			if !c.expectChild {
+				if child != nil {
+					t.Errorf("expected no http.server span, but got one described %q", child.Description)
+				}
+				// The tag is set on the state of whichever Handler finishes
+				// the transaction.
+				if transaction.Tags["upload"] != "true" {
+					t.Errorf("expected upload tag to be %q, but got %q", "true", transaction.Tags["upload"])
+				}
+				return
+			}
+
+			if child == nil {
+				t.Fatal("expected an http.server span, but got none")
+			}
+			if expect := "POST /upload"; child.Description != expect {
+				t.Errorf("expected span description %q, but got %q", expect, child.Description)
+			}
+		})
+	}
+}
+
+func TestHandler_ShortCircuitingMiddleware(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{})
+	r.Use(func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	})
+	r.Get("/admin", func(http.ResponseWriter, *http.Request) {
+		t.Error("handler called despite the middleware responding")
+	})
+
+	serve(r, http.MethodGet, "/admin")
+
+	transaction := onlyTransaction(t, rec)
+	// The request never reached the router, so the initial name is kept.
+	if expect := "/admin"; transaction.Name != expect {
+		t.Errorf("expected name %q, but got %q", expect, transaction.Name)
+	}
+	if transaction.Status != sentry.SpanStatusUnauthenticated {
+		t.Errorf("expected status %s, but got %s", sentry.SpanStatusUnauthenticated, transaction.Status)
+	}
+}
+
+func TestDeferFinish(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{RequestTiming: chisentry.RequestTimingLate})
+
+	finishes := make(chan func(), 1)
+	r.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		finishes <- chisentry.DeferFinish(r.Context())
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	serve(r, http.MethodGet, "/users/1")
+
+	if ts := rec.Transactions(); len(ts) != 0 {
+		t.Fatalf("expected no transaction before the finish, but got %d", len(ts))
+	}
+
+	(<-finishes)()
+
+	// By now, chi has reused the route context of the request, so the
+	// transaction must be finished from the snapshot taken when the handler
+	// returned.
+	transaction := onlyTransaction(t, rec)
+	if expect := "GET /users/{id}"; transaction.Name != expect {
+		t.Errorf("expected name %q, but got %q", expect, transaction.Name)
+	}
+	if transaction.Status != sentry.SpanStatusOK {
+		t.Errorf("expected status %s, but got %s", sentry.SpanStatusOK, transaction.Status)
+	}
+	if request := transaction.Event.Request; request == nil || !strings.HasSuffix(request.URL, "/users/1") {
+		t.Errorf("expected the transaction to contain the request, but got %+v", request)
+	}
+}
+
+func TestHandler_DeferredPanic(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{})
+	r.Get("/", func(http.ResponseWriter, *http.Request) {
+		defer func() {
+			panic("deferred")
+		}()
+	})
+
+	serve(r, http.MethodGet, "/")
+
+	errs := rec.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, but got %d", len(errs))
+	}
+	if errs[0].Message != "deferred" {
+		t.Errorf("expected error with message %q, but got %q", "deferred", errs[0].Message)
+	}
+
+	if transaction := onlyTransaction(t, rec); transaction.Status != sentry.SpanStatusInternalError {
+		t.Errorf("expected status %s, but got %s", sentry.SpanStatusInternalError, transaction.Status)
+	}
+}
+
+func BenchmarkHandle(b *testing.B) {
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		EnableTracing:    true,
+		TracesSampleRate: 1,
+		Transport:        discardTransport{},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Use the current hub, so that the hub is cloned for every request, as
+	// in production.
+	hub := sentry.CurrentHub()
+	prevClient := hub.Client()
+	hub.BindClient(client)
+	defer hub.BindClient(prevClient)
+
+	panicking := func(http.ResponseWriter, *http.Request) { panic("benchmark") }
+
+	benchmarks := []struct {
+		name    string
+		options chisentry.Options
+		handler http.HandlerFunc
+	}{
+		{name: "ok", handler: func(http.ResponseWriter, *http.Request) {}},
+		{name: "panic", handler: panicking},
+		{
+			name:    "panic low memory",
+			options: chisentry.Options{LowMemoryPanicReport: true},
+			handler: panicking,
+		},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			handler := chisentry.New(bm.options).HandleFunc(bm.handler)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// The Handler replaces the context of the request it handles.
+				req := *r
+				handler.ServeHTTP(w, &req)
+			}
+		})
+	}
+}
+
+// hijackableRecorder is an httptest.ResponseRecorder that can be hijacked.
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	// conn is the server side of the hijacked connection.
+	conn net.Conn
+}
+
+func (w *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+func TestHandler_Upgrade(t *testing.T) {
+	testCases := []struct {
+		name   string
+		hijack bool
+		// expectStatus is the expected http.status_code data, or nil if
+		// none is expected.
+		expectStatus interface{}
+	}{
+		{name: "hijacked", hijack: true, expectStatus: http.StatusSwitchingProtocols},
+		{name: "not hijacked", hijack: false, expectStatus: nil},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			r, rec := newRouter(chisentry.Options{})
+			r.Get("/ws", func(w http.ResponseWriter, _ *http.Request) {
+				if !c.hijack {
+					return
+				}
+
+				conn, rw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+
+				// Write the response to the connection directly, as
+				// WebSocket libraries do.
+				_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+					"Upgrade: websocket\r\n" +
+					"Connection: Upgrade\r\n\r\n")
+				_ = rw.Flush()
+			})
+
+			server, client := net.Pipe()
+			defer client.Close()
+			go func() { _, _ = io.Copy(io.Discard, client) }()
+
+			req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			r.ServeHTTP(&hijackableRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}, req)
+
+			transaction := onlyTransaction(t, rec)
+			if status := transaction.Data["http.status_code"]; status != c.expectStatus {
+				t.Errorf("expected http.status_code %v, but got %v", c.expectStatus, status)
+			}
+		})
+	}
+}
+
+func TestHandler_MethodNotAllowed(t *testing.T) {
+	testCases := []struct {
+		name string
+		// methodNotAllowed is the MethodNotAllowed handler of the router, or
+		// nil to use chi's default.
+		methodNotAllowed http.HandlerFunc
+		// expectAllow is the expected http.allow data, or nil if none is
+		// expected.
+		expectAllow interface{}
+	}{
+		{name: "default"},
+		{
+			name: "custom",
+			methodNotAllowed: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Allow", http.MethodGet)
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			},
+			expectAllow: http.MethodGet,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			r, rec := newRouter(chisentry.Options{})
+			if c.methodNotAllowed != nil {
+				r.MethodNotAllowed(c.methodNotAllowed)
+			}
+			r.Get("/users", func(http.ResponseWriter, *http.Request) {
+				t.Error("handler called despite the method not being allowed")
+			})
+
+			if w := serve(r, http.MethodPost, "/users"); w.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("expected status %d, but got %d", http.StatusMethodNotAllowed, w.Code)
+			}
+
+			transaction := onlyTransaction(t, rec)
+			if tag := transaction.Tags["route.method_not_allowed"]; tag != "true" {
+				t.Errorf("expected route.method_not_allowed tag %q, but got %q", "true", tag)
+			}
+			if allow := transaction.Data["http.allow"]; allow != c.expectAllow {
+				t.Errorf("expected http.allow data %v, but got %v", c.expectAllow, allow)
+			}
+		})
+	}
+}
+
+func TestHandler_NotFoundStatus(t *testing.T) {
+	// silent is a middleware that neither calls the next handler, nor
+	// writes a response.
+	silent := func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	}
+	panicking := func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("middleware") })
+	}
+
+	testCases := []struct {
+		name           string
+		notFoundStatus bool
+		// middleware is the middleware used by the router, or nil.
+		middleware func(http.Handler) http.Handler
+		target     string
+		// expectData is the expected http.status_code data, or nil if none
+		// is expected.
+		expectData   interface{}
+		expectStatus sentry.SpanStatus
+	}{
+		{
+			name: "unrouted/disabled", middleware: silent, target: "/users",
+			expectData: nil, expectStatus: sentry.SpanStatusUnknown,
+		},
+		{
+			name: "unrouted/enabled", notFoundStatus: true, middleware: silent, target: "/users",
+			expectData: http.StatusNotFound, expectStatus: sentry.SpanStatusNotFound,
+		},
+		{
+			name: "routed/disabled", target: "/users",
+			expectData: nil, expectStatus: sentry.SpanStatusUnknown,
+		},
+		{
+			name: "routed/enabled", notFoundStatus: true, target: "/users",
+			expectData: nil, expectStatus: sentry.SpanStatusUnknown,
+		},
+		{
+			name: "no route/disabled", target: "/posts",
+			expectData: http.StatusNotFound, expectStatus: sentry.SpanStatusNotFound,
+		},
+		{
+			name: "no route/enabled", notFoundStatus: true, target: "/posts",
+			expectData: http.StatusNotFound, expectStatus: sentry.SpanStatusNotFound,
+		},
+		{
+			name: "panicked/enabled", notFoundStatus: true, middleware: panicking, target: "/users",
+			expectData: nil, expectStatus: sentry.SpanStatusInternalError,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			r, rec := newRouter(chisentry.Options{NotFoundStatus: c.notFoundStatus})
+			if c.middleware != nil {
+				r.Use(c.middleware)
+			}
+			// The handler writes no response.
+			r.Get("/users", func(http.ResponseWriter, *http.Request) {})
+
+			serve(r, http.MethodGet, c.target)
+
+			transaction := onlyTransaction(t, rec)
+			if status := transaction.Data["http.status_code"]; status != c.expectData {
+				t.Errorf("expected http.status_code %v, but got %v", c.expectData, status)
+			}
+			if transaction.Status != c.expectStatus {
+				t.Errorf("expected status %s, but got %s", c.expectStatus, transaction.Status)
+			}
+		})
+	}
+}
+
+func TestSetMeasurement_DeferredFinish(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{DeferredFinishTimeout: time.Millisecond})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		chisentry.DeferFinish(ctx)
+		// Makes the Handler set the http.status_code data when finishing.
+		w.WriteHeader(http.StatusAccepted)
+		chisentry.SetMeasurement(ctx, "items", 1, chisentry.MeasurementUnitNone)
+
+		// Keep setting measurements while the transaction is finished after
+		// the timeout, so that the race detector can catch unsynchronized
+		// access to the transaction.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+					chisentry.SetMeasurement(ctx, "late", float64(i), chisentry.MeasurementUnitNone)
+				}
+			}
+		}()
+	})
+
+	serve(r, http.MethodGet, "/")
+
+	for deadline := time.Now().Add(time.Second); len(rec.Transactions()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Serialize the transaction while measurements are still being set, as
+	// a transport would.
+	transaction := onlyTransaction(t, rec)
+	if _, err := json.Marshal(transaction.Data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := transaction.Data["measurement.items"]; !ok {
+		t.Error("expected the transaction to contain the items measurement")
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestDisableBreadcrumbs(t *testing.T) {
+	// addBreadcrumbs adds n breadcrumbs with the passed message to the hub of
+	// r.
+	addBreadcrumbs := func(r *http.Request, message string, n int) {
+		hub := sentry.GetHubFromContext(r.Context())
+		for i := 0; i < n; i++ {
+			hub.AddBreadcrumb(&sentry.Breadcrumb{Message: message}, nil)
+		}
+	}
+
+	testCases := []struct {
+		name string
+		// before and after are the number of breadcrumbs added before and
+		// after DisableBreadcrumbs is called.
+		before, after int
+		nested        bool
+		// expect is the number of breadcrumbs expected on the event.
+		expect int
+	}{
+		{name: "below MaxBreadcrumbs", before: 2, after: 3, expect: 2},
+		{name: "nested", before: 2, after: 3, nested: true, expect: 2},
+		{
+			// The default MaxBreadcrumbs of the client is 30, so the later
+			// breadcrumbs evict one of the earlier ones.
+			name:   "past MaxBreadcrumbs",
+			before: 2,
+			after:  29,
+			expect: 1,
+		},
+		{name: "only later breadcrumbs", before: 2, after: 30, expect: 0},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			r, rec := newRouter(chisentry.Options{})
+			if c.nested {
+				// With NestedTransactionChild, the handler sees the state of
+				// the inner Handler, which didn't add any event processors.
+				r.Use(chisentry.New(chisentry.Options{
+					NestedTransactionPolicy: chisentry.NestedTransactionChild,
+				}).Handle)
+			}
+			r.Get("/", func(_ http.ResponseWriter, r *http.Request) {
+				addBreadcrumbs(r, "before", c.before)
+				chisentry.DisableBreadcrumbs(r.Context())
+				addBreadcrumbs(r, "after", c.after)
+
+				sentry.GetHubFromContext(r.Context()).CaptureMessage("message")
+			})
+
+			serve(r, http.MethodGet, "/")
+
+			errs := rec.Errors()
+			if len(errs) != 1 {
+				t.Fatalf("expected 1 event, but got %d", len(errs))
+			}
+
+			breadcrumbs := errs[0].Breadcrumbs
+			if len(breadcrumbs) != c.expect {
+				t.Errorf("expected %d breadcrumbs, but got %d", c.expect, len(breadcrumbs))
+			}
+			for _, b := range breadcrumbs {
+				if b.Message != "before" {
+					t.Errorf("expected only breadcrumbs added before DisableBreadcrumbs, but got %q", b.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_RoutingSpan(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{RoutingSpan: true})
+	r.Use(chisentry.EndRouting)
+	r.Get("/", func(_ http.ResponseWriter, r *http.Request) {
+		sentry.GetHubFromContext(r.Context()).CaptureMessage("message")
+	})
+
+	serve(r, http.MethodGet, "/")
+
+	transaction := onlyTransaction(t, rec)
+	if len(transaction.Spans) != 1 || transaction.Spans[0].Op != "http.route" {
+		t.Fatalf("expected a single http.route span, but got %v", transaction.Spans)
+	}
+
+	errs := rec.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 event, but got %d", len(errs))
+	}
+	// Events must reference the transaction, not the routing span.
+	expect := transaction.Event.Contexts["trace"]["span_id"]
+	if actual := errs[0].Contexts["trace"]["span_id"]; actual != expect {
+		t.Errorf("expected the event to reference span %v, but got %v", expect, actual)
+	}
+}
+
+func TestSetTag(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{})
+	r.Get("/", func(_ http.ResponseWriter, r *http.Request) {
+		chisentry.SetTag(r.Context(), "tenant", "acme")
+		sentry.GetHubFromContext(r.Context()).CaptureMessage("message")
+	})
+
+	serve(r, http.MethodGet, "/")
+
+	if tenant := onlyTransaction(t, rec).Tags["tenant"]; tenant != "acme" {
+		t.Errorf("expected the transaction to have the tenant tag acme, but got %q", tenant)
+	}
+
+	errs := rec.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 event, but got %d", len(errs))
+	}
+	if tenant, ok := errs[0].Tags["tenant"]; ok {
+		t.Errorf("expected the event to not have the tenant tag, but got %q", tenant)
+	}
+}
+
+func TestHandler_Goexit(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{})
+	r.Get("/", func(http.ResponseWriter, *http.Request) {
+		runtime.Goexit()
+	})
+
+	// Serve in a goroutine of its own, since Goexit terminates it.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(r, http.MethodGet, "/")
+	}()
+	<-done
+
+	transaction := onlyTransaction(t, rec)
+	if transaction.Status != sentry.SpanStatusInternalError {
+		t.Errorf("expected status %s, but got %s", sentry.SpanStatusInternalError, transaction.Status)
+	}
+	if transaction.Tags["abnormal_exit"] != "true" {
+		t.Errorf("expected abnormal_exit tag to be %q, but got %q", "true", transaction.Tags["abnormal_exit"])
+	}
+	if errs := rec.Errors(); len(errs) != 0 {
+		t.Errorf("expected no errors, but got %d", len(errs))
+	}
+}
+
+func TestHandler_MaxRequestBodySize(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{MaxRequestBodySize: 4})
+
+	var called bool
+	r.Post("/", func(http.ResponseWriter, *http.Request) {
+		called = true
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large")))
+
+	if called {
+		t.Error("expected the handler to not be called")
+	}
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, but got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	transaction := onlyTransaction(t, rec)
+	if reason := transaction.Tags["rejected.reason"]; reason != "body_too_large" {
+		t.Errorf("expected rejected.reason tag to be %q, but got %q", "body_too_large", reason)
+	}
+	if _, ok := transaction.Tags["abnormal_exit"]; ok {
+		t.Error("expected the rejected request to not be tagged as abnormal exit")
+	}
+}
+
+func TestHandler_CallbackPanic(t *testing.T) {
+	h, rec := sentrytest.New(chisentry.Options{
+		ClaimsTagger: func(*http.Request) map[string]string {
+			panic("claims")
+		},
+	})
+
+	var called bool
+	handler := h.HandleFunc(func(http.ResponseWriter, *http.Request) {
+		called = true
+	})
+	serve(handler, http.MethodGet, "/")
+
+	if called {
+		t.Error("expected the handler to not be called")
+	}
+	if errs := rec.Errors(); len(errs) != 1 {
+		t.Errorf("expected 1 error, but got %d", len(errs))
+	}
+
+	// The request must have been removed from the in-flight requests.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Errorf("expected Shutdown to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,437 @@
+package chi
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+type requestStateKey struct{}
+
+// requestState is the state of a request handled by a Handler.
+// It is stored in the request's context.
+type requestState struct {
+	hub         *sentry.Hub
+	transaction *sentry.Span
+	ww          middleware.WrapResponseWriter
+	r           *http.Request
+	// ctx is the context of r, as passed to the Handler.
+	// Unlike r.Context(), it isn't replaced by Options.ContextFunc.
+	ctx   context.Context
+	start time.Time
+	// hijack records whether the connection was hijacked, if the request
+	// asked for a protocol upgrade, or is nil.
+	hijack *hijackRecorder
+	// cronCheckIn is the check-in of the request, if it is a check-in of a
+	// cron monitor, or nil.
+	cronCheckIn *cronCheckIn
+	// routingSpan is the span started if Options.RoutingSpan is set, or nil.
+	routingSpan *sentry.Span
+	// lastEventID is the id of the last event captured using hub, before the
+	// request was handled.
+	lastEventID sentry.EventID
+	// nameHeader is the headerStripper used to remove the
+	// TransactionNameHeader, or nil if it isn't removed.
+	nameHeader *headerStripper
+	// outer is the state of the request in the outer Handler, if that
+	// Handler uses the same hub, and therefore added the event processors.
+	outer *requestState
+
+	finish     func()
+	finishOnce sync.Once
+
+	mu        sync.Mutex
+	status    sentry.SpanStatus
+	statusSet bool
+	skipped   bool
+	panicked  bool
+	// exitedAbnormally is true if the handler called runtime.Goexit.
+	exitedAbnormally bool
+	// finishDeferred is true if DeferFinish was called.
+	finishDeferred bool
+	// handedOff is true if the transaction was adopted by a nested Handler,
+	// which finishes it instead.
+	handedOff bool
+	// timer finishes the transaction, if the finish was deferred, and the
+	// transaction wasn't finished before the DeferredFinishTimeout.
+	timer *time.Timer
+	// snapshot is the snapshot of the response the transaction is finished
+	// with.
+	// It is set when the handler returns, if the finish is deferred, or
+	// otherwise when the transaction is finished.
+	snapshot *responseSnapshot
+	// measurements are the measurements set using SetMeasurement, keyed by
+	// their data key.
+	// They are added to the transaction right before it is finished, since
+	// the data of the transaction must not be modified concurrently.
+	measurements map[string]interface{}
+	// endTime is the end time set using SetTransactionEndTime.
+	endTime time.Time
+	// tags are the tags set using SetTag.
+	// Like measurements, they are added to the transaction right before it
+	// is finished.
+	tags map[string]string
+	// breadcrumbsDisabled is true if DisableBreadcrumbs was called.
+	breadcrumbsDisabled bool
+	// breadcrumbsDisabledAt is the time DisableBreadcrumbs was called.
+	breadcrumbsDisabledAt time.Time
+}
+
+// responseSnapshot is a snapshot of the routing result and the response of a
+// request.
+//
+// Transactions are finished using a snapshot, since a deferred finish happens
+// after ServeHTTP returned, at which point chi has already reused the
+// request's route context, and the response writer must not be used anymore.
+type responseSnapshot struct {
+	routeMethod   string
+	routePattern  string
+	routePatterns []string
+	status        int
+	// header contains the values of the response headers needed to finish
+	// the transaction.
+	header http.Header
+}
+
+// requestStateFromContext returns the requestState stored in ctx, or nil if
+// ctx is not the context of a request handled by a Handler.
+func requestStateFromContext(ctx context.Context) *requestState {
+	state, _ := ctx.Value(requestStateKey{}).(*requestState)
+	return state
+}
+
+// finishTransaction finishes the request's transaction, if it hasn't been
+// finished already.
+func (s *requestState) finishTransaction() {
+	s.finishOnce.Do(s.doFinish)
+}
+
+// doFinish stops the timer of a deferred finish, if any, and finishes the
+// transaction.
+// It must only be called through finishOnce.
+func (s *requestState) doFinish() {
+	s.mu.Lock()
+	timer := s.timer
+	s.mu.Unlock()
+
+	if timer != nil {
+		timer.Stop()
+	}
+	s.finish()
+}
+
+// finishAfterHandler is called after the handler returned, and finishes the
+// transaction, unless DeferFinish was called.
+// In that case, it stores the snapshot returned by takeSnapshot, and the
+// transaction is finished after timeout, if it wasn't finished by then.
+func (s *requestState) finishAfterHandler(
+	timeout time.Duration, takeSnapshot func(*requestState) *responseSnapshot,
+) {
+	s.mu.Lock()
+	deferred := s.finishDeferred
+	s.mu.Unlock()
+
+	if !deferred {
+		s.finishTransaction()
+		return
+	}
+
+	snapshot := takeSnapshot(s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.snapshot == nil {
+		s.snapshot = snapshot
+	}
+	s.timer = time.AfterFunc(timeout, s.finishTransaction)
+}
+
+// loadSnapshot returns the snapshot the transaction is finished with, or nil
+// if none was taken yet.
+func (s *requestState) loadSnapshot() *responseSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.snapshot
+}
+
+// loadMeasurements returns a copy of the measurements set using
+// SetMeasurement.
+func (s *requestState) loadMeasurements() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	measurements := make(map[string]interface{}, len(s.measurements))
+	for key, value := range s.measurements {
+		measurements[key] = value
+	}
+	return measurements
+}
+
+// loadTags returns a copy of the tags set using SetTag.
+func (s *requestState) loadTags() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tags := make(map[string]string, len(s.tags))
+	for key, value := range s.tags {
+		tags[key] = value
+	}
+	return tags
+}
+
+// explicitStatus returns the status set using SetTransactionStatus, and
+// whether one was set.
+func (s *requestState) explicitStatus() (sentry.SpanStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status, s.statusSet
+}
+
+// explicitEndTime returns the end time set using SetTransactionEndTime, and
+// whether one was set.
+func (s *requestState) explicitEndTime() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.endTime, !s.endTime.IsZero()
+}
+
+// isSkipped reports whether the request is marked as skipped by Skip.
+func (s *requestState) isSkipped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.skipped
+}
+
+// hasPanicked reports whether the handler panicked.
+func (s *requestState) hasPanicked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.panicked
+}
+
+// isHandedOff reports whether the transaction was adopted by a nested
+// Handler.
+func (s *requestState) isHandedOff() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.handedOff
+}
+
+// hasExitedAbnormally reports whether the handler called runtime.Goexit.
+func (s *requestState) hasExitedAbnormally() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.exitedAbnormally
+}
+
+// FinishTransaction finishes the transaction of the request with the passed
+// context immediately, instead of when the handler returns.
+//
+// This is useful for handlers that continue working after they sent their
+// response, e.g. by starting a goroutine, so that the duration of the
+// transaction reflects the time it took to respond.
+// The transaction is named and statused as if the handler returned.
+//
+// Spans started after the transaction was finished won't be attached to it.
+//
+// If ctx is not the context of a request handled by a Handler, or if the
+// transaction was already finished, FinishTransaction is a no-op.
+func FinishTransaction(ctx context.Context) {
+	if state := requestStateFromContext(ctx); state != nil {
+		state.finishTransaction()
+	}
+}
+
+// DeferFinish takes over the responsibility of finishing the transaction of
+// the request with the passed context, from the Handler.
+// The transaction is no longer finished when the handler returns, but when
+// the returned function is called.
+//
+// This is useful for handlers that return, but continue working in the
+// background, e.g. to stream a response, so that the transaction reflects
+// the real duration of the work.
+// Note that the request's context is canceled once the handler returns.
+//
+// If the returned function is not called within the DeferredFinishTimeout
+// after the handler returned, the transaction is finished anyway.
+//
+// If ctx is not the context of a request handled by a Handler, the returned
+// function is a no-op.
+func DeferFinish(ctx context.Context) (finish func()) {
+	state := requestStateFromContext(ctx)
+	if state == nil {
+		return func() {}
+	}
+
+	state.mu.Lock()
+	state.finishDeferred = true
+	state.mu.Unlock()
+
+	return state.finishTransaction
+}
+
+// SetTransactionStatus sets the status of the transaction of the request with
+// the passed context.
+//
+// By default, the status of the transaction is derived from the HTTP status
+// of the response.
+// SetTransactionStatus overrides that status, allowing handlers to report
+// the outcome of a request more precisely, e.g. when a request responded
+// with 200 OK, but failed semantically.
+//
+// If ctx is not the context of a request handled by a Handler,
+// SetTransactionStatus is a no-op.
+func SetTransactionStatus(ctx context.Context, status sentry.SpanStatus) {
+	state := requestStateFromContext(ctx)
+	if state == nil {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.status = status
+	state.statusSet = true
+}
+
+// SetTransactionEndTime sets the end time of the transaction of the request
+// with the passed context.
+//
+// By default, a transaction ends when the handler returns, or, if DeferFinish
+// was called, when the transaction is finished.
+// SetTransactionEndTime overrides that time, e.g. to align the duration of
+// the transaction of a proxied request with the duration measured by the
+// upstream server.
+// The end time is also used to compute the duration of the request passed to
+// Options.TailSampler and Options.MetricsObserver.
+//
+// If ctx is not the context of a request handled by a Handler,
+// SetTransactionEndTime is a no-op.
+func SetTransactionEndTime(ctx context.Context, t time.Time) {
+	state := requestStateFromContext(ctx)
+	if state == nil {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.endTime = t
+}
+
+// SetTag sets the tag with the passed key and value on the transaction of the
+// request with the passed context.
+//
+// Unlike tags set on the scope of the request's hub, the tag is only added to
+// the transaction, and not to the error events captured during the request.
+//
+// Tags set after the transaction was finished are discarded.
+//
+// If ctx is not the context of a request handled by a Handler, SetTag is a
+// no-op.
+func SetTag(ctx context.Context, key, value string) {
+	state := requestStateFromContext(ctx)
+	if state == nil {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.tags == nil {
+		state.tags = make(map[string]string)
+	}
+	state.tags[key] = value
+}
+
+// Skip is a middleware that disables the instrumentation of the routes it is
+// applied to.
+// Transactions of requests to those routes are not sent to Sentry.
+// Panics are still recovered from and reported, however.
+//
+// Skip must be used inside a router wrapped by a Handler, e.g.:
+//
+//	r.Use(h.Handle)
+//	r.With(chisentry.Skip).Get("/healthz", healthz)
+func Skip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state := requestStateFromContext(r.Context()); state != nil {
+			state.mu.Lock()
+			state.skipped = true
+			state.mu.Unlock()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// EndRouting is a middleware that finishes the span started for the routing
+// phase of requests, if Options.RoutingSpan is set.
+//
+// It must be the last middleware applied to the routes, e.g.:
+//
+//	r.Use(h.Handle)
+//	r.Use(auth)
+//	r.Use(chisentry.EndRouting)
+func EndRouting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state := requestStateFromContext(r.Context()); state != nil && state.routingSpan != nil {
+			state.routingSpan.Finish()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RoutePattern returns the route pattern of the request with the passed
+// context, as resolved by the Handler.
+//
+// The route pattern is resolved when the transaction of the request is
+// finished.
+// Before that, the route pattern matched so far is returned.
+//
+// If ctx is not the context of a request handled by a Handler, or if the
+// request matched no route, RoutePattern returns "".
+func RoutePattern(ctx context.Context) string {
+	state := requestStateFromContext(ctx)
+	if state == nil {
+		return ""
+	}
+
+	if snapshot := state.loadSnapshot(); snapshot != nil {
+		return snapshot.routePattern
+	}
+
+	if rctx := chi.RouteContext(ctx); rctx != nil {
+		return rctx.RoutePattern()
+	}
+	return ""
+}
+
+// AddAttachment adds the passed attachment to the scope of the hub of the
+// request with the passed context, so that it is sent along with all events
+// captured afterwards during that request.
+//
+// Sentry limits the size of attachments, and events with oversized
+// attachments may be dropped.
+// Therefore, attachments should be kept small.
+//
+// If ctx has no hub, AddAttachment is a no-op.
+func AddAttachment(ctx context.Context, a *sentry.Attachment) {
+	if hub := sentry.GetHubFromContext(ctx); hub != nil {
+		hub.Scope().AddAttachment(a)
+	}
+}
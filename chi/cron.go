@@ -0,0 +1,49 @@
+package chi
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// cronCheckIn is a check-in of a request to a cron monitor.
+type cronCheckIn struct {
+	slug string
+	// id is the id of the in-progress check-in, or nil if it wasn't sent.
+	id *sentry.EventID
+}
+
+// startCronCheckIn sends an in-progress check-in to the monitor with the
+// passed slug.
+func startCronCheckIn(hub *sentry.Hub, slug string) *cronCheckIn {
+	id := hub.CaptureCheckIn(&sentry.CheckIn{
+		MonitorSlug: slug,
+		Status:      sentry.CheckInStatusInProgress,
+	}, nil)
+	return &cronCheckIn{slug: slug, id: id}
+}
+
+// finish sends a check-in that completes c.
+// The check-in's status is error, if failed is true, and ok otherwise.
+func (c *cronCheckIn) finish(hub *sentry.Hub, failed bool, duration time.Duration) {
+	checkIn := &sentry.CheckIn{
+		MonitorSlug: c.slug,
+		Status:      sentry.CheckInStatusOK,
+		Duration:    duration,
+	}
+	if c.id != nil {
+		checkIn.ID = *c.id
+	}
+	if failed {
+		checkIn.Status = sentry.CheckInStatusError
+	}
+
+	hub.CaptureCheckIn(checkIn, nil)
+}
+
+// cronFailed reports whether a request to a cron monitor failed, i.e. whether
+// it panicked, exited abnormally, or responded with a server error.
+func cronFailed(state *requestState, status int) bool {
+	return state.hasPanicked() || state.hasExitedAbnormally() || status >= http.StatusInternalServerError
+}
@@ -0,0 +1,58 @@
+package chi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// PanicError is the error returned by functions wrapped using Go, if they
+// panic.
+type PanicError struct {
+	// Value is the value the function panicked with.
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns Value, if it is an error, and nil otherwise.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Go wraps f, so that panics in f are recovered from and reported to the hub
+// stored in ctx.
+// If f panics, the returned function returns a *PanicError instead.
+//
+// The recover of a Handler only covers the goroutine the wrapped handler is
+// run in.
+// Go extends this to goroutines started by the handler, e.g. when fanning out
+// requests using an errgroup.Group:
+//
+//	g, gctx := errgroup.WithContext(r.Context())
+//	g.Go(chisentry.Go(gctx, func() error {
+//		// ...
+//	}))
+//
+// If ctx has no hub, the current hub is used.
+func Go(ctx context.Context, f func() error) func() error {
+	return func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				hub := sentry.GetHubFromContext(ctx)
+				if hub == nil {
+					hub = sentry.CurrentHub()
+				}
+
+				hub.RecoverWithContext(ctx, v)
+				err = &PanicError{Value: v}
+			}
+		}()
+
+		return f()
+	}
+}
@@ -0,0 +1,93 @@
+package chi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// headerStripper is an http.ResponseWriter, that removes a header from the
+// response before it is written, remembering its value.
+//
+// It implements all optional interfaces used by middleware.WrapResponseWriter,
+// falling back to a no-op or an error, if the underlying writer doesn't
+// implement them.
+type headerStripper struct {
+	http.ResponseWriter
+	name string
+
+	stripped bool
+	val      string
+}
+
+var (
+	_ http.Flusher  = (*headerStripper)(nil)
+	_ http.Hijacker = (*headerStripper)(nil)
+	_ http.Pusher   = (*headerStripper)(nil)
+	_ io.ReaderFrom = (*headerStripper)(nil)
+)
+
+func newHeaderStripper(w http.ResponseWriter, name string) *headerStripper {
+	return &headerStripper{ResponseWriter: w, name: name}
+}
+
+// value removes the header from the response, if that hasn't happened yet,
+// and returns its value.
+func (s *headerStripper) value() string {
+	if !s.stripped {
+		s.stripped = true
+		s.val = s.Header().Get(s.name)
+		s.Header().Del(s.name)
+	}
+	return s.val
+}
+
+func (s *headerStripper) WriteHeader(code int) {
+	s.value()
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *headerStripper) Write(p []byte) (int, error) {
+	s.value()
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *headerStripper) Flush() {
+	s.value()
+	if fl, ok := s.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (s *headerStripper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := s.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, fmt.Errorf(
+		"chisentry: response writer does not implement http.Hijacker: %w", http.ErrNotSupported,
+	)
+}
+
+func (s *headerStripper) Push(target string, opts *http.PushOptions) error {
+	if ps, ok := s.ResponseWriter.(http.Pusher); ok {
+		return ps.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+func (s *headerStripper) ReadFrom(r io.Reader) (int64, error) {
+	s.value()
+	if rf, ok := s.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	// Hide ReadFrom from io.Copy, so that it doesn't call it recursively.
+	return io.Copy(struct{ io.Writer }{s.ResponseWriter}, r)
+}
+
+// Unwrap returns the underlying writer, so that http.ResponseController can
+// reach methods of it that aren't forwarded.
+func (s *headerStripper) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,75 @@
+package chi
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// hijackRecorder is an http.ResponseWriter that records whether its
+// connection was hijacked.
+//
+// Use newHijackRecorder to wrap a writer in a hijackRecorder that implements
+// the same optional interfaces used by middleware.WrapResponseWriter for
+// HTTP/1.x as the original writer.
+type hijackRecorder struct {
+	http.ResponseWriter
+	hijacked atomic.Bool
+}
+
+var _ http.Hijacker = (*hijackRecorder)(nil)
+
+// newHijackRecorder wraps w, which must implement http.Hijacker, in a
+// hijackRecorder.
+// It returns the writer to use in place of w, and the recorder.
+func newHijackRecorder(w http.ResponseWriter) (http.ResponseWriter, *hijackRecorder) {
+	rec := &hijackRecorder{ResponseWriter: w}
+
+	_, fl := w.(http.Flusher)
+	_, rf := w.(io.ReaderFrom)
+	switch {
+	case fl && rf:
+		return fancyHijackRecorder{flushHijackRecorder{rec}}, rec
+	case fl:
+		return flushHijackRecorder{rec}, rec
+	default:
+		return rec, rec
+	}
+}
+
+func (rec *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := rec.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		rec.hijacked.Store(true)
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the original writer, for use by http.ResponseController.
+func (rec *hijackRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// wasHijacked reports whether the connection was hijacked.
+// rec may be nil, in which case wasHijacked returns false.
+func (rec *hijackRecorder) wasHijacked() bool {
+	return rec != nil && rec.hijacked.Load()
+}
+
+type flushHijackRecorder struct{ *hijackRecorder }
+
+var _ http.Flusher = flushHijackRecorder{}
+
+func (rec flushHijackRecorder) Flush() {
+	rec.ResponseWriter.(http.Flusher).Flush()
+}
+
+type fancyHijackRecorder struct{ flushHijackRecorder }
+
+var _ io.ReaderFrom = fancyHijackRecorder{}
+
+func (rec fancyHijackRecorder) ReadFrom(r io.Reader) (int64, error) {
+	return rec.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+}
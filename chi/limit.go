@@ -0,0 +1,89 @@
+package chi
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// lowPriorityExtras are the keys of the extras set by the Handler, that are
+// dropped first, if an event exceeds the maximum size.
+var lowPriorityExtras = []string{"response.body", "cookies"}
+
+// limitEventData returns an event processor that drops the data of events
+// exceeding maxBytes, until the event fits.
+//
+// Data is dropped in the following order:
+//
+//  1. The body of the request.
+//  2. The cookies of the request.
+//  3. The extras in lowPriorityExtras.
+//  4. All other extras, from largest to smallest.
+//
+// If data was dropped, the event is tagged with event.truncated.
+func limitEventData(maxBytes int) sentry.EventProcessor {
+	return func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+		size := eventSize(event)
+		if size <= maxBytes {
+			return event
+		}
+
+		drops := make([]func(), 0, 2+len(event.Extra))
+		if event.Request != nil {
+			drops = append(drops,
+				func() { event.Request.Data = "" },
+				func() { event.Request.Cookies = "" })
+		}
+		for _, key := range lowPriorityExtras {
+			key := key
+			drops = append(drops, func() { delete(event.Extra, key) })
+		}
+		for _, key := range extrasBySize(event.Extra) {
+			key := key
+			drops = append(drops, func() { delete(event.Extra, key) })
+		}
+
+		for _, drop := range drops {
+			drop()
+			if size = eventSize(event); size <= maxBytes {
+				break
+			}
+		}
+
+		if event.Tags == nil {
+			event.Tags = make(map[string]string, 1)
+		}
+		event.Tags["event.truncated"] = "true"
+		sentry.Logger.Printf("Dropped data from event %s to fit MaxEventDataBytes, event has %d bytes", event.EventID, size)
+
+		return event
+	}
+}
+
+// eventSize returns the size of the JSON representation of event.
+func eventSize(event *sentry.Event) int {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// extrasBySize returns the keys of extras, sorted by the size of the JSON
+// representation of their values, from largest to smallest.
+func extrasBySize(extras map[string]interface{}) []string {
+	keys := make([]string, 0, len(extras))
+	sizes := make(map[string]int, len(extras))
+	for k, v := range extras {
+		keys = append(keys, k)
+
+		b, err := json.Marshal(v)
+		if err == nil {
+			sizes[k] = len(b)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return sizes[keys[i]] > sizes[keys[j]] })
+	return keys
+}
@@ -0,0 +1,74 @@
+package chi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// LogWriter returns an io.Writer that writes to w, prefixing each line with
+// the ids of the trace and span of the request with the passed context, in
+// the format
+//
+//	trace_id=<trace id> span_id=<span id> <line>
+//
+// This allows correlating the log lines of unstructured loggers with the
+// request's transaction, e.g.:
+//
+//	logger := log.New(chisentry.LogWriter(r.Context(), os.Stderr), "", log.LstdFlags)
+//
+// The span is the innermost span stored in ctx, i.e. the request's
+// transaction, unless ctx is the context of a child span.
+//
+// If ctx has no span, LogWriter returns w.
+func LogWriter(ctx context.Context, w io.Writer) io.Writer {
+	span := sentry.SpanFromContext(ctx)
+	if span == nil {
+		return w
+	}
+
+	return &logWriter{
+		w:           w,
+		prefix:      []byte("trace_id=" + span.TraceID.String() + " span_id=" + span.SpanID.String() + " "),
+		atLineStart: true,
+	}
+}
+
+type logWriter struct {
+	w      io.Writer
+	prefix []byte
+
+	mu          sync.Mutex
+	atLineStart bool
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf := make([]byte, 0, len(p)+len(w.prefix))
+	for rest := p; len(rest) > 0; {
+		if w.atLineStart {
+			buf = append(buf, w.prefix...)
+		}
+
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			buf = append(buf, rest...)
+			w.atLineStart = false
+			break
+		}
+
+		buf = append(buf, rest[:i+1]...)
+		rest = rest[i+1:]
+		w.atLineStart = true
+	}
+
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
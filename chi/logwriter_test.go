@@ -0,0 +1,45 @@
+package chi_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+)
+
+func TestLogWriter(t *testing.T) {
+	t.Run("prefix", func(t *testing.T) {
+		span := sentry.StartSpan(context.Background(), "http.server")
+		prefix := "trace_id=" + span.TraceID.String() + " span_id=" + span.SpanID.String() + " "
+
+		var buf bytes.Buffer
+		w := chisentry.LogWriter(span.Context(), &buf)
+
+		// Lines may be written in parts, and multiple lines at once.
+		for _, s := range []string{"first", " line\nsecond line\n", "third line\n"} {
+			n, err := io.WriteString(w, s)
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			if n != len(s) {
+				t.Errorf("expected %d bytes to be written, but got %d", len(s), n)
+			}
+		}
+
+		expect := prefix + "first line\n" + prefix + "second line\n" + prefix + "third line\n"
+		if buf.String() != expect {
+			t.Errorf("expected output %q, but got %q", expect, buf.String())
+		}
+	})
+
+	t.Run("no span", func(t *testing.T) {
+		var buf bytes.Buffer
+		if w := chisentry.LogWriter(context.Background(), &buf); w != io.Writer(&buf) {
+			t.Errorf("expected the writer to be returned as is, but got %T", w)
+		}
+	})
+}
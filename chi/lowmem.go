@@ -0,0 +1,47 @@
+package chi
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/go-chi/chi/v5"
+)
+
+// captureLowMemoryPanic reports the panic value v using a minimal event,
+// that only contains the type and message of the panic, and the route
+// pattern of r.
+//
+// The event is captured by the client of hub directly, so that the scope,
+// including the request and its body, is not applied to it.
+func captureLowMemoryPanic(hub *sentry.Hub, r *http.Request, v interface{}) *sentry.EventID {
+	client := hub.Client()
+	if client == nil {
+		return nil
+	}
+
+	var msg string
+	switch v := v.(type) {
+	case error:
+		msg = v.Error()
+	case string:
+		msg = v
+	default:
+		msg = fmt.Sprint(v)
+	}
+
+	event := &sentry.Event{
+		Level:   sentry.LevelFatal,
+		Message: msg,
+		Exception: []sentry.Exception{
+			{Type: fmt.Sprintf("%T", v), Value: msg},
+		},
+	}
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			event.Tags = map[string]string{"route": pattern}
+		}
+	}
+
+	return client.CaptureEvent(event, nil, nil)
+}
@@ -0,0 +1,49 @@
+package chi
+
+import (
+	"context"
+)
+
+// MeasurementUnit is the unit of a measurement.
+type MeasurementUnit string
+
+// Common measurement units, as used by Sentry.
+const (
+	MeasurementUnitNone        MeasurementUnit = "none"
+	MeasurementUnitMillisecond MeasurementUnit = "millisecond"
+	MeasurementUnitSecond      MeasurementUnit = "second"
+	MeasurementUnitByte        MeasurementUnit = "byte"
+	MeasurementUnitRatio       MeasurementUnit = "ratio"
+	MeasurementUnitPercent     MeasurementUnit = "percent"
+)
+
+// SetMeasurement records the measurement with the passed name, value and unit
+// on the transaction of the request with the passed context, e.g. the number
+// of items processed by the request.
+// Setting a measurement with the same name twice overwrites the first value.
+// Measurements set after the transaction was finished are discarded.
+//
+// The Sentry SDK doesn't support transaction measurements yet.
+// Measurements are therefore stored in the data of the transaction, under
+// the key "measurement.<name>", and are shown in the trace view, but not as
+// measurements in the performance product.
+//
+// If ctx is not the context of a request handled by a Handler, SetMeasurement
+// is a no-op.
+func SetMeasurement(ctx context.Context, name string, value float64, unit MeasurementUnit) {
+	state := requestStateFromContext(ctx)
+	if state == nil {
+		return
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.measurements == nil {
+		state.measurements = make(map[string]interface{})
+	}
+	state.measurements["measurement."+name] = map[string]interface{}{
+		"value": value,
+		"unit":  unit,
+	}
+}
@@ -0,0 +1,39 @@
+//go:build go1.21
+
+//go:debug panicnil=0
+
+package chi_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+)
+
+func TestHandler_PanicNil(t *testing.T) {
+	r, rec := newRouter(chisentry.Options{})
+	r.Get("/", func(http.ResponseWriter, *http.Request) {
+		panic(nil)
+	})
+
+	serve(r, http.MethodGet, "/")
+
+	errs := rec.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, but got %d", len(errs))
+	}
+	exceptions := errs[0].Exception
+	if len(exceptions) == 0 {
+		t.Fatal("expected the error to have an exception")
+	}
+	if expect, actual := "*runtime.PanicNilError", exceptions[len(exceptions)-1].Type; actual != expect {
+		t.Errorf("expected exception of type %s, but got %s", expect, actual)
+	}
+
+	if transaction := onlyTransaction(t, rec); transaction.Status != sentry.SpanStatusInternalError {
+		t.Errorf("expected status %s, but got %s", sentry.SpanStatusInternalError, transaction.Status)
+	}
+}
@@ -0,0 +1,55 @@
+package chi
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// parseQueueStart parses the value of a queue start header, as set by load
+// balancers and proxies, e.g. "t=1600000000.123".
+//
+// The value may be prefixed with "t=", and is either a Unix timestamp in
+// seconds with a fractional part, or an integer Unix timestamp in seconds,
+// milliseconds or microseconds, which is detected by its magnitude.
+func parseQueueStart(value string) (time.Time, bool) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "t=")
+
+	if strings.Contains(value, ".") {
+		secs, err := strconv.ParseFloat(value, 64)
+		if err != nil || secs <= 0 {
+			return time.Time{}, false
+		}
+		return time.Unix(0, int64(secs*float64(time.Second))), true
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}, false
+	}
+
+	switch {
+	case n > 1e15:
+		return time.UnixMicro(n), true
+	case n > 1e12:
+		return time.UnixMilli(n), true
+	default:
+		return time.Unix(n, 0), true
+	}
+}
+
+// startQueueSpan records a finished child span of transaction with the op
+// queue.wait, that covers the time from queueStart until now.
+func startQueueSpan(transaction *sentry.Span, queueStart, now time.Time) {
+	if !queueStart.Before(now) {
+		return
+	}
+
+	span := sentry.StartSpan(transaction.Context(), "queue.wait")
+	span.StartTime = queueStart
+	span.EndTime = now
+	span.Finish()
+	restoreTraceContext(transaction)
+}
@@ -0,0 +1,54 @@
+package chi
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter that is safe for concurrent use.
+type rateLimiter struct {
+	mu sync.Mutex
+	// perSecond is both the number of tokens added per second and the
+	// capacity of the bucket.
+	perSecond float64
+	tokens    float64
+	// last is the time tokens were last added, or zero, if allow wasn't
+	// called yet.
+	last time.Time
+}
+
+// newRateLimiter returns a new rateLimiter, whose bucket is full until the
+// first call to allow.
+// Since the limiter doesn't read the clock itself, it always uses the same
+// clock as its caller.
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{
+		perSecond: float64(perSecond),
+		tokens:    float64(perSecond),
+	}
+}
+
+// allow reports whether a token is available at the time now, and takes it,
+// if so.
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last.IsZero() {
+		l.last = now
+	}
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.perSecond
+		if l.tokens > l.perSecond {
+			l.tokens = l.perSecond
+		}
+		l.last = now
+	}
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
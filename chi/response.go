@@ -0,0 +1,65 @@
+package chi
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// responseBodyBuffer buffers the first bytes of the body of a response with a
+// server error status.
+// It is used as the tee of a middleware.WrapResponseWriter.
+type responseBodyBuffer struct {
+	ww  middleware.WrapResponseWriter
+	max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newResponseBodyBuffer(ww middleware.WrapResponseWriter, maxBytes int) *responseBodyBuffer {
+	return &responseBodyBuffer{ww: ww, max: maxBytes}
+}
+
+// Write buffers p, if the status of the response is a server error and the
+// buffer is not yet full.
+// It never fails.
+func (b *responseBodyBuffer) Write(p []byte) (int, error) {
+	if b.ww.Status() < http.StatusInternalServerError {
+		return len(p), nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n := b.max - len(b.buf); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		b.buf = append(b.buf, p[:n]...)
+	}
+
+	return len(p), nil
+}
+
+// eventProcessor returns an event processor that attaches the buffered body
+// as the response.body extra, if it is not empty.
+func (b *responseBodyBuffer) eventProcessor() sentry.EventProcessor {
+	return func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+		b.mu.Lock()
+		body := string(b.buf)
+		b.mu.Unlock()
+
+		if body == "" {
+			return event
+		}
+
+		if event.Extra == nil {
+			event.Extra = make(map[string]interface{}, 1)
+		}
+		event.Extra["response.body"] = body
+		return event
+	}
+}
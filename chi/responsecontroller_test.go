@@ -0,0 +1,124 @@
+//go:build go1.20
+
+package chi_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+)
+
+// bareWriter is an http.ResponseWriter that implements none of the optional
+// interfaces.
+type bareWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *bareWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *bareWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *bareWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// deadlineWriter is a bareWriter that supports write deadlines, which aren't
+// forwarded by the wrapped writer.
+type deadlineWriter struct {
+	bareWriter
+	deadline time.Time
+}
+
+func (w *deadlineWriter) SetWriteDeadline(deadline time.Time) error {
+	w.deadline = deadline
+	return nil
+}
+
+func TestHandler_ResponseController(t *testing.T) {
+	t.Run("bare writer", func(t *testing.T) {
+		h := chisentry.New(chisentry.Options{})
+
+		var called bool
+		handler := h.HandleFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+
+			if _, ok := w.(http.Flusher); ok {
+				t.Error("expected writer to not implement http.Flusher")
+			}
+			if _, ok := w.(http.Hijacker); ok {
+				t.Error("expected writer to not implement http.Hijacker")
+			}
+
+			rc := http.NewResponseController(w)
+			if err := rc.Flush(); !errors.Is(err, http.ErrNotSupported) {
+				t.Errorf("expected Flush to return http.ErrNotSupported, got %v", err)
+			}
+			if _, _, err := rc.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+				t.Errorf("expected Hijack to return http.ErrNotSupported, got %v", err)
+			}
+		})
+
+		handler.ServeHTTP(new(bareWriter), httptest.NewRequest(http.MethodGet, "/", nil))
+		if !called {
+			t.Fatal("handler was not called")
+		}
+	})
+
+	t.Run("unwrap", func(t *testing.T) {
+		testCases := []struct {
+			name    string
+			options chisentry.Options
+		}{
+			{name: "default"},
+			{
+				// The headerStripper sits between the original writer and
+				// the writer passed to the handler.
+				name: "strip transaction name header",
+				options: chisentry.Options{
+					TransactionNameHeader:      "X-Transaction-Name",
+					StripTransactionNameHeader: true,
+				},
+			},
+		}
+
+		for _, c := range testCases {
+			t.Run(c.name, func(t *testing.T) {
+				h := chisentry.New(c.options)
+
+				deadline := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+				handler := h.HandleFunc(func(w http.ResponseWriter, r *http.Request) {
+					rc := http.NewResponseController(w)
+					if err := rc.SetWriteDeadline(deadline); err != nil {
+						t.Errorf("expected SetWriteDeadline to succeed, got %v", err)
+					}
+					if _, _, err := rc.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+						t.Errorf("expected Hijack to return http.ErrNotSupported, got %v", err)
+					}
+				})
+
+				w := new(deadlineWriter)
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				if !w.deadline.Equal(deadline) {
+					t.Errorf("expected write deadline %s, got %s", deadline, w.deadline)
+				}
+			})
+		}
+	})
+}
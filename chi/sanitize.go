@@ -0,0 +1,94 @@
+package chi
+
+import (
+	"strings"
+)
+
+// minHexIDLength is the minimum length of a hexadecimal path segment, for it
+// to be considered an id, e.g. a hash.
+const minHexIDLength = 16
+
+// SanitizeIDs replaces the path segments of name that look like ids with
+// placeholders:
+//
+//   - UUIDs, e.g. "0b0a3d1e-7c1f-4b4e-9f3a-1c2d3e4f5a6b", are replaced by
+//     ":uuid"
+//   - numbers, e.g. "123", and hexadecimal strings of at least 16
+//     characters, e.g. hashes, are replaced by ":id"
+//
+// For example, "GET /users/123/files/0b0a3d1e-7c1f-4b4e-9f3a-1c2d3e4f5a6b"
+// becomes "GET /users/:id/files/:uuid".
+//
+// SanitizeIDs can be used as Options.NameNormalizer, to prevent ids in the
+// paths of requests handled by catch-all routes or mounted third-party
+// handlers from making the names of transactions unique.
+func SanitizeIDs(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		switch {
+		case isUUID(segment):
+			segments[i] = ":uuid"
+		case isNumeric(segment), len(segment) >= minHexIDLength && isHex(segment):
+			segments[i] = ":id"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// isUUID reports whether s is a UUID in its canonical textual
+// representation.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHexDigit(s[i]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// isNumeric reports whether s is a non-empty string of decimal digits.
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isHex reports whether s is a non-empty string of hexadecimal digits.
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !isHexDigit(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
@@ -0,0 +1,70 @@
+package chi_test
+
+import (
+	"testing"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+)
+
+func TestSanitizeIDs(t *testing.T) {
+	testCases := []struct {
+		name   string
+		in     string
+		expect string
+	}{
+		{name: "empty", in: "", expect: ""},
+		{name: "root", in: "GET /", expect: "GET /"},
+		{name: "no ids", in: "GET /users/me", expect: "GET /users/me"},
+		{name: "numeric", in: "GET /users/123", expect: "GET /users/:id"},
+		{name: "zero", in: "GET /users/0", expect: "GET /users/:id"},
+		{name: "signed number", in: "GET /users/-1", expect: "GET /users/-1"},
+		{name: "partly numeric", in: "GET /v1/users", expect: "GET /v1/users"},
+		{
+			name:   "uuid",
+			in:     "GET /files/0b0a3d1e-7c1f-4b4e-9f3a-1c2d3e4f5a6b",
+			expect: "GET /files/:uuid",
+		},
+		{
+			name:   "upper case uuid",
+			in:     "GET /files/0B0A3D1E-7C1F-4B4E-9F3A-1C2D3E4F5A6B",
+			expect: "GET /files/:uuid",
+		},
+		{
+			name:   "uuid without dashes",
+			in:     "GET /files/0b0a3d1e7c1f4b4e9f3a1c2d3e4f5a6b",
+			expect: "GET /files/:id",
+		},
+		{
+			name:   "uuid with misplaced dashes",
+			in:     "GET /files/0b0a3d1e7-c1f-4b4e-9f3a-1c2d3e4f5a6b",
+			expect: "GET /files/0b0a3d1e7-c1f-4b4e-9f3a-1c2d3e4f5a6b",
+		},
+		{
+			name:   "uuid with non-hex digit",
+			in:     "GET /files/0b0a3d1e-7c1f-4b4e-9f3a-1c2d3e4f5a6g",
+			expect: "GET /files/0b0a3d1e-7c1f-4b4e-9f3a-1c2d3e4f5a6g",
+		},
+		{name: "hex", in: "GET /commits/da39a3ee5e6b4b0d", expect: "GET /commits/:id"},
+		{
+			name:   "long hex",
+			in:     "GET /commits/da39a3ee5e6b4b0d3255bfef95601890afd80709",
+			expect: "GET /commits/:id",
+		},
+		{name: "short hex", in: "GET /colors/deadbeef", expect: "GET /colors/deadbeef"},
+		{name: "hex-like word", in: "GET /feedface/cafe", expect: "GET /feedface/cafe"},
+		{
+			name:   "multiple ids",
+			in:     "GET /users/123/files/0b0a3d1e-7c1f-4b4e-9f3a-1c2d3e4f5a6b",
+			expect: "GET /users/:id/files/:uuid",
+		},
+		{name: "trailing slash", in: "GET /users/123/", expect: "GET /users/:id/"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := chisentry.SanitizeIDs(c.in); actual != c.expect {
+				t.Errorf("expected %q, but got %q", c.expect, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Package sentrytest provides utilities for testing code instrumented using a
+// chi.Handler.
+package sentrytest
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+)
+
+// Transaction is a transaction captured by a Recorder.
+type Transaction struct {
+	// Name is the name of the transaction.
+	Name string
+	// Status is the status of the transaction.
+	Status sentry.SpanStatus
+	// Tags are the tags of the transaction.
+	Tags map[string]string
+	// Data is the data of the transaction.
+	Data map[string]interface{}
+	// Spans are the finished child spans of the transaction.
+	Spans []*sentry.Span
+
+	// Event is the event the transaction was sent as.
+	Event *sentry.Event
+}
+
+// Recorder is a sentry.Transport that records all events sent through it in
+// memory.
+//
+// It is safe for concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	events []*sentry.Event
+}
+
+var _ sentry.Transport = (*Recorder)(nil)
+
+// Configure implements sentry.Transport.
+func (*Recorder) Configure(sentry.ClientOptions) {}
+
+// SendEvent implements sentry.Transport by recording event.
+func (rec *Recorder) SendEvent(event *sentry.Event) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.events = append(rec.events, event)
+}
+
+// Flush implements sentry.Transport.
+// Since events are recorded synchronously, it returns true immediately.
+func (*Recorder) Flush(time.Duration) bool { return true }
+
+// Events returns all events recorded so far, including transactions.
+func (rec *Recorder) Events() []*sentry.Event {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	events := make([]*sentry.Event, len(rec.events))
+	copy(events, rec.events)
+	return events
+}
+
+// Errors returns all recorded events that aren't transactions, such as
+// captured errors, messages and panics.
+func (rec *Recorder) Errors() []*sentry.Event {
+	var errs []*sentry.Event
+	for _, e := range rec.Events() {
+		if e.Type != "transaction" {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// Transactions returns all transactions recorded so far.
+func (rec *Recorder) Transactions() []Transaction {
+	var ts []Transaction
+	for _, e := range rec.Events() {
+		if e.Type != "transaction" {
+			continue
+		}
+
+		t := Transaction{
+			Name:  e.Transaction,
+			Tags:  e.Tags,
+			Data:  e.Extra,
+			Spans: e.Spans,
+			Event: e,
+		}
+		if status, ok := e.Contexts["trace"]["status"].(sentry.SpanStatus); ok {
+			t.Status = status
+		}
+
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// Reset discards all events recorded so far.
+func (rec *Recorder) Reset() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.events = nil
+}
+
+// Handler is a *chisentry.Handler bound to a hub of its own, whose client
+// sends all events to a Recorder, and samples all transactions.
+type Handler struct {
+	*chisentry.Handler
+	hub *sentry.Hub
+}
+
+// New returns a new Handler created using options, and the Recorder that
+// records the events it sends.
+//
+// Use the returned Handler just like a *chisentry.Handler, e.g.:
+//
+//	h, rec := sentrytest.New(chisentry.Options{})
+//	r := chi.NewRouter()
+//	r.Use(h.Handle)
+//	r.Get("/users/{id}", getUser)
+//
+//	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1", nil))
+//	ts := rec.Transactions() // ts[0].Name == "GET /users/{id}"
+func New(options chisentry.Options) (*Handler, *Recorder) {
+	rec := new(Recorder)
+
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport:        rec,
+		EnableTracing:    true,
+		TracesSampleRate: 1,
+	})
+	if err != nil {
+		// Only possible if the DSN is invalid, which we don't set.
+		panic(err)
+	}
+
+	return &Handler{
+		Handler: chisentry.New(options),
+		hub:     sentry.NewHub(client, sentry.NewScope()),
+	}, rec
+}
+
+// Handle works like chisentry.Handler.Handle, but uses h's hub instead of
+// the current hub.
+func (h *Handler) Handle(handler http.Handler) http.Handler {
+	return h.bind(h.Handler.Handle(handler))
+}
+
+// HandleFunc works like chisentry.Handler.HandleFunc, but uses h's hub
+// instead of the current hub.
+func (h *Handler) HandleFunc(handler http.HandlerFunc) http.HandlerFunc {
+	return h.bind(h.Handler.HandleFunc(handler))
+}
+
+// bind returns a handler that calls handler with a clone of h's hub stored in
+// the request's context.
+func (h *Handler) bind(handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(sentry.SetHubOnContext(r.Context(), h.hub.Clone())))
+	}
+}
@@ -0,0 +1,129 @@
+package chi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// inFlightTracker tracks the transactions that have been started but not yet
+// finished.
+type inFlightTracker struct {
+	mu     sync.Mutex
+	n      int
+	closed bool
+	// done is closed when the tracker is closed and n reaches 0.
+	done chan struct{}
+}
+
+// add adds a transaction, and reports whether that was possible, i.e.
+// whether the tracker is not closed.
+func (t *inFlightTracker) add() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.n++
+	return true
+}
+
+// release removes a transaction added using add.
+func (t *inFlightTracker) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.n--
+	if t.closed && t.n == 0 {
+		close(t.done)
+	}
+}
+
+// close closes the tracker, preventing further transactions from being
+// added.
+// The returned channel is closed once all added transactions are released.
+func (t *inFlightTracker) close() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		t.done = make(chan struct{})
+		if t.n == 0 {
+			close(t.done)
+		}
+	}
+	return t.done
+}
+
+// Shutdown stops the Handler from tracing new requests, waits for the
+// transactions of in-flight requests to be finished, and flushes all
+// buffered events to Sentry.
+//
+// The events are flushed using the client of the current hub, and the
+// clients of all hubs returned by Options.HubProvider so far.
+//
+// Requests handled after Shutdown was called are still handled, and panics
+// are still recovered from and reported, but they aren't traced.
+//
+// If ctx has a deadline, it is used as the timeout for flushing, otherwise
+// Options.Timeout is used.
+// Shutdown returns ctx.Err(), if ctx is done before all transactions are
+// finished, and an error, if not all events could be flushed.
+//
+// Shutdown is meant to be called after http.Server.Shutdown returned, which
+// waits for all handlers to return.
+// Calling Shutdown afterwards additionally waits for transactions whose
+// finishing was deferred using DeferFinish:
+//
+//	if err := srv.Shutdown(ctx); err != nil {
+//		// handle err
+//	}
+//	if err := h.Shutdown(ctx); err != nil {
+//		// handle err
+//	}
+func (h *Handler) Shutdown(ctx context.Context) error {
+	select {
+	case <-h.inFlight.close():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	timeout := h.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	var clients []*sentry.Client
+	if client := sentry.CurrentHub().Client(); client != nil {
+		clients = append(clients, client)
+	}
+	h.providedClients.Range(func(client, _ interface{}) bool {
+		clients = append(clients, client.(*sentry.Client))
+		return true
+	})
+
+	// Flush concurrently, so that all clients get the full timeout.
+	var wg sync.WaitGroup
+	var timedOut atomic.Bool
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *sentry.Client) {
+			defer wg.Done()
+			if !client.Flush(timeout) {
+				timedOut.Store(true)
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	if timedOut.Load() {
+		return errors.New("chisentry: timed out flushing events")
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package chi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// StartSpan starts a child span with the passed op and description, of the
+// span stored in ctx, usually the transaction of the request.
+// It returns a copy of ctx with the new span stored in it, so that spans
+// started using the returned context are children of the new span.
+//
+// The span must be finished by the caller, e.g.:
+//
+//	ctx, span := chisentry.StartSpan(r.Context(), "db.sql.query", "SELECT * FROM users")
+//	defer span.Finish()
+//
+// If ctx has no span, the span is started as a transaction.
+func StartSpan(ctx context.Context, op, description string) (context.Context, *sentry.Span) {
+	span := sentry.StartSpan(ctx, op)
+	span.Description = description
+	return span.Context(), span
+}
+
+// StartSpanf is like StartSpan, but formats the description according to
+// the passed format specifier.
+func StartSpanf(ctx context.Context, op, descFormat string, args ...interface{}) (context.Context, *sentry.Span) {
+	return StartSpan(ctx, op, fmt.Sprintf(descFormat, args...))
+}
@@ -0,0 +1,30 @@
+package chi_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+)
+
+func TestStartSpanf(t *testing.T) {
+	transaction := sentry.StartTransaction(context.Background(), "GET /users/{id}")
+
+	ctx, span := chisentry.StartSpanf(transaction.Context(), "db.sql.query", "SELECT * FROM %s WHERE id = %d", "users", 1)
+	defer span.Finish()
+
+	if expect := "SELECT * FROM users WHERE id = 1"; span.Description != expect {
+		t.Errorf("expected description %q, but got %q", expect, span.Description)
+	}
+	if span.Op != "db.sql.query" {
+		t.Errorf("expected op %q, but got %q", "db.sql.query", span.Op)
+	}
+	if span.ParentSpanID != transaction.SpanID {
+		t.Error("expected span to be a child of the transaction")
+	}
+	if sentry.SpanFromContext(ctx) != span {
+		t.Error("expected returned context to hold the span")
+	}
+}
@@ -0,0 +1,62 @@
+package chi
+
+import (
+	"errors"
+	"sort"
+)
+
+// Validate checks o for invalid values and conflicting options, and returns
+// an error describing the first problem found, or nil if o is valid.
+//
+// The following are reported:
+//
+//   - negative durations, limits and sizes
+//   - unknown NestedTransactionPolicy and RequestTiming values
+//   - CaptureSlowRequests without a SlowRequestThreshold
+//   - StripTransactionNameHeader without a TransactionNameHeader
+//   - RequestTimingLate with DisableRequestCapture, as no request is captured
+//   - MinimalRequestCapture with DisableRequestCapture, as no request is
+//     captured
+//   - unsorted LatencyBuckets
+//   - AttachRuntimeStatsOnPanic with LowMemoryPanicReport, as the runtime
+//     stats are not included in low memory panic reports
+func (o Options) Validate() error {
+	switch {
+	case o.Timeout < 0:
+		return errors.New("chisentry: Timeout must not be negative")
+	case o.PanicFlushTimeout < 0:
+		return errors.New("chisentry: PanicFlushTimeout must not be negative")
+	case o.DeferredFinishTimeout < 0:
+		return errors.New("chisentry: DeferredFinishTimeout must not be negative")
+	case o.SlowRequestThreshold < 0:
+		return errors.New("chisentry: SlowRequestThreshold must not be negative")
+	case o.MaxPanicReportsPerSecond < 0:
+		return errors.New("chisentry: MaxPanicReportsPerSecond must not be negative")
+	case o.MaxEventDataBytes < 0:
+		return errors.New("chisentry: MaxEventDataBytes must not be negative")
+	case o.MaxResponseBodyCapture < 0:
+		return errors.New("chisentry: MaxResponseBodyCapture must not be negative")
+	case o.MaxRequestBodySize < 0:
+		return errors.New("chisentry: MaxRequestBodySize must not be negative")
+	case o.MaxBreadcrumbs < 0:
+		return errors.New("chisentry: MaxBreadcrumbs must not be negative")
+	case o.NestedTransactionPolicy > NestedTransactionSkip:
+		return errors.New("chisentry: unknown NestedTransactionPolicy")
+	case o.RequestTiming > RequestTimingLate:
+		return errors.New("chisentry: unknown RequestTiming")
+	case o.CaptureSlowRequests && o.SlowRequestThreshold == 0:
+		return errors.New("chisentry: CaptureSlowRequests requires a SlowRequestThreshold")
+	case o.StripTransactionNameHeader && o.TransactionNameHeader == "":
+		return errors.New("chisentry: StripTransactionNameHeader requires a TransactionNameHeader")
+	case o.RequestTiming == RequestTimingLate && o.DisableRequestCapture:
+		return errors.New("chisentry: RequestTimingLate has no effect if DisableRequestCapture is set")
+	case o.MinimalRequestCapture && o.DisableRequestCapture:
+		return errors.New("chisentry: MinimalRequestCapture has no effect if DisableRequestCapture is set")
+	case !sort.SliceIsSorted(o.LatencyBuckets, func(i, j int) bool { return o.LatencyBuckets[i] < o.LatencyBuckets[j] }):
+		return errors.New("chisentry: LatencyBuckets must be sorted in ascending order")
+	case o.AttachRuntimeStatsOnPanic && o.LowMemoryPanicReport:
+		return errors.New("chisentry: AttachRuntimeStatsOnPanic has no effect if LowMemoryPanicReport is set")
+	}
+
+	return nil
+}
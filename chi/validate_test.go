@@ -0,0 +1,109 @@
+package chi_test
+
+import (
+	"testing"
+	"time"
+
+	chisentry "github.com/mavolin/chi-sentry/chi"
+)
+
+func TestOptions_Validate(t *testing.T) {
+	testCases := []struct {
+		name      string
+		options   chisentry.Options
+		expectErr bool
+	}{
+		{name: "zero", options: chisentry.Options{}},
+		{
+			name: "valid",
+			options: chisentry.Options{
+				Timeout:                    time.Second,
+				CaptureSlowRequests:        true,
+				SlowRequestThreshold:       time.Second,
+				TransactionNameHeader:      "X-Transaction-Name",
+				StripTransactionNameHeader: true,
+				RequestTiming:              chisentry.RequestTimingLate,
+				LatencyBuckets:             []time.Duration{time.Millisecond, time.Second},
+			},
+		},
+		{name: "negative Timeout", options: chisentry.Options{Timeout: -1}, expectErr: true},
+		{name: "negative PanicFlushTimeout", options: chisentry.Options{PanicFlushTimeout: -1}, expectErr: true},
+		{
+			name:      "negative DeferredFinishTimeout",
+			options:   chisentry.Options{DeferredFinishTimeout: -1},
+			expectErr: true,
+		},
+		{
+			name:      "negative SlowRequestThreshold",
+			options:   chisentry.Options{SlowRequestThreshold: -1},
+			expectErr: true,
+		},
+		{
+			name:      "negative MaxPanicReportsPerSecond",
+			options:   chisentry.Options{MaxPanicReportsPerSecond: -1},
+			expectErr: true,
+		},
+		{name: "negative MaxEventDataBytes", options: chisentry.Options{MaxEventDataBytes: -1}, expectErr: true},
+		{
+			name:      "negative MaxResponseBodyCapture",
+			options:   chisentry.Options{MaxResponseBodyCapture: -1},
+			expectErr: true,
+		},
+		{name: "negative MaxRequestBodySize", options: chisentry.Options{MaxRequestBodySize: -1}, expectErr: true},
+		{name: "negative MaxBreadcrumbs", options: chisentry.Options{MaxBreadcrumbs: -1}, expectErr: true},
+		{
+			name:      "unknown NestedTransactionPolicy",
+			options:   chisentry.Options{NestedTransactionPolicy: chisentry.NestedTransactionSkip + 1},
+			expectErr: true,
+		},
+		{
+			name:      "unknown RequestTiming",
+			options:   chisentry.Options{RequestTiming: chisentry.RequestTimingLate + 1},
+			expectErr: true,
+		},
+		{
+			name:      "CaptureSlowRequests without SlowRequestThreshold",
+			options:   chisentry.Options{CaptureSlowRequests: true},
+			expectErr: true,
+		},
+		{
+			name:      "StripTransactionNameHeader without TransactionNameHeader",
+			options:   chisentry.Options{StripTransactionNameHeader: true},
+			expectErr: true,
+		},
+		{
+			name: "RequestTimingLate with DisableRequestCapture",
+			options: chisentry.Options{
+				RequestTiming:         chisentry.RequestTimingLate,
+				DisableRequestCapture: true,
+			},
+			expectErr: true,
+		},
+		{
+			name:      "MinimalRequestCapture with DisableRequestCapture",
+			options:   chisentry.Options{MinimalRequestCapture: true, DisableRequestCapture: true},
+			expectErr: true,
+		},
+		{
+			name:      "unsorted LatencyBuckets",
+			options:   chisentry.Options{LatencyBuckets: []time.Duration{time.Second, time.Millisecond}},
+			expectErr: true,
+		},
+		{
+			name:      "AttachRuntimeStatsOnPanic with LowMemoryPanicReport",
+			options:   chisentry.Options{AttachRuntimeStatsOnPanic: true, LowMemoryPanicReport: true},
+			expectErr: true,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.options.Validate()
+			if c.expectErr && err == nil {
+				t.Error("expected an error, but got nil")
+			} else if !c.expectErr && err != nil {
+				t.Errorf("expected no error, but got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package chi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// VersionFromAccept returns the API version encoded in the vendor media types
+// of the Accept header of r, e.g. "v2" for "application/vnd.myapp.v2+json".
+// It can be used as Options.APIVersion.
+//
+// If the Accept header contains no vendor media type with a version, "" is
+// returned.
+func VersionFromAccept(r *http.Request) string {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			if v := versionFromMediaType(mediaRange); v != "" {
+				return v
+			}
+		}
+	}
+
+	return ""
+}
+
+// versionFromMediaType returns the version segment of the vendor media type
+// mediaType, or "" if it has none.
+func versionFromMediaType(mediaType string) string {
+	if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+
+	_, subtype, ok := strings.Cut(strings.TrimSpace(mediaType), "/")
+	if !ok || !strings.HasPrefix(subtype, "vnd.") {
+		return ""
+	}
+
+	if i := strings.IndexByte(subtype, '+'); i >= 0 {
+		subtype = subtype[:i]
+	}
+
+	for _, segment := range strings.Split(subtype, ".") {
+		if isVersion(segment) {
+			return segment
+		}
+	}
+
+	return ""
+}
+
+// isVersion reports whether s is a version of the form "v" followed by one or
+// more digits.
+func isVersion(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
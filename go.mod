@@ -2,10 +2,12 @@ module github.com/mavolin/chi-sentry
 
 go 1.19
 
-require github.com/getsentry/sentry-go v0.16.0
+require (
+	github.com/getsentry/sentry-go v0.23.0
+	github.com/go-chi/chi/v5 v5.0.8
+)
 
 require (
-	github.com/go-chi/chi/v5 v5.0.8 // indirect
-	golang.org/x/sys v0.0.0-20220928140112-f11e5e49a4ec // indirect
-	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.8.0 // indirect
 )